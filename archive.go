@@ -0,0 +1,427 @@
+package logging
+
+import "bufio"
+import "crypto/aes"
+import "crypto/cipher"
+import "crypto/rand"
+import "crypto/rsa"
+import "crypto/sha256"
+import "crypto/x509"
+import "encoding/binary"
+import "encoding/pem"
+import "errors"
+import "io"
+import "io/ioutil"
+import "os"
+import "strings"
+
+// An encrypted archive is the backup file name followed by ".enc":
+//
+//	magic | mode | key length | wrapped data key | chunk...
+//
+// A random AES-256 data key encrypts the file in chunks of 64KB with
+// AES-GCM, each chunk is its length followed by the sealed data. The nonce
+// of a chunk is its index with a flag set on the last one, so reordered,
+// dropped or truncated chunks fail to decrypt. The data key is sealed with
+// the archive key using AES-GCM or encrypted to the public key with
+// RSA-OAEP
+const archiveSuffix = ".enc"
+
+var archiveMagic = []byte("LOGENC1\n")
+
+const (
+	archiveModeKey byte = 1
+	archiveModeRSA byte = 2
+)
+
+const archiveChunkSize = 64 * 1024
+
+var archiveLabel = []byte("logging archive key")
+
+var ErrArchiveCorrupt = errors.New("encrypted archive is corrupt, truncated or the key is wrong")
+
+type archiveEncrypter struct {
+	key    []byte
+	public *rsa.PublicKey
+}
+
+// SetArchiveKey encrypts each backup with AES-GCM after a rotation, key is
+// 16, 24 or 32 bytes. The backup is encrypted in the background, renamed
+// with ".enc" appended and the retention of the handler counts it as
+// before. nil stops encrypting
+func (handler *BasicHandler) SetArchiveKey(key []byte) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if key == nil {
+		handler.archive = nil
+		return
+	}
+	_, err = aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	handler.archive = &archiveEncrypter{key: append([]byte(nil), key...)}
+	return
+}
+
+// SetArchivePublicKey encrypts each backup after a rotation so that only
+// the holder of the private key can read it, nil stops encrypting
+func (handler *BasicHandler) SetArchivePublicKey(public *rsa.PublicKey) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if public == nil {
+		handler.archive = nil
+		return
+	}
+	if public.Size()-2*sha256.Size-2 < 32 {
+		err = errors.New("RSA key is too small to hold an AES-256 key")
+		return
+	}
+	handler.archive = &archiveEncrypter{public: public}
+	return
+}
+
+// encryptBackup replaces a rotated file with its encrypted archive in the
+// background, the plain file is kept when encryption fails. done, such as
+// the retention of the backups, runs once the archive is written. A handler
+// encrypts one backup at a time: the next rotation waits for the previous
+// backup, which only delays writes when rotations come faster than a backup
+// can be encrypted
+func (handler *BasicHandler) encryptBackup(fileName string, done func()) {
+	handler.waitArchive()
+	if handler.archive == nil {
+		if done != nil {
+			done()
+		}
+		return
+	}
+	encrypter := handler.archive
+	perm := handler.permissions()
+	report := handler.errorHandler
+	if report == nil {
+		report = getErrorHandler()
+	}
+	finished := make(chan struct{})
+	handler.archiveDone = finished
+	go func() {
+		defer close(finished)
+		err := encrypter.encryptFile(fileName, perm)
+		if err != nil && report != nil {
+			report(err)
+		}
+		if done != nil {
+			done()
+		}
+	}()
+}
+
+// waitArchive waits for the backup being encrypted, it is called with the
+// handler locked before a rotation and on close
+func (handler *BasicHandler) waitArchive() {
+	if handler.archiveDone != nil {
+		<-handler.archiveDone
+		handler.archiveDone = nil
+	}
+}
+
+func (encrypter *archiveEncrypter) header(dataKey []byte) (header []byte, err error) {
+	header = append(header, archiveMagic...)
+	var wrapped []byte
+	if encrypter.public != nil {
+		header = append(header, archiveModeRSA)
+		wrapped, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, encrypter.public, dataKey, archiveLabel)
+		if err != nil {
+			return
+		}
+	} else {
+		header = append(header, archiveModeKey)
+		aead, err1 := newGCM(encrypter.key)
+		if err1 != nil {
+			return nil, err1
+		}
+		nonce := make([]byte, aead.NonceSize())
+		_, err = io.ReadFull(rand.Reader, nonce)
+		if err != nil {
+			return
+		}
+		wrapped = aead.Seal(nonce, nonce, dataKey, header)
+	}
+	header = append(header, byte(len(wrapped)>>8), byte(len(wrapped)))
+	return append(header, wrapped...), nil
+}
+
+func newGCM(key []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(nonce []byte, index uint64, last bool) []byte {
+	binary.BigEndian.PutUint64(nonce, index)
+	nonce[8], nonce[9], nonce[10], nonce[11] = 0, 0, 0, 0
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptFile writes fileName.enc next to fileName, with its permissions,
+// and removes fileName once the archive is complete
+func (encrypter *archiveEncrypter) encryptFile(fileName string, perm Permissions) (err error) {
+	src, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return
+	}
+	tmpName := fileName + archiveSuffix + ".tmp"
+	dst, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return
+	}
+	err = dst.Chmod(info.Mode().Perm())
+	if err == nil {
+		err = perm.apply(dst)
+	}
+	if err == nil {
+		err = encrypter.encrypt(dst, src)
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	err1 := dst.Close()
+	if err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fileName+archiveSuffix)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return
+	}
+	return os.Remove(fileName)
+}
+
+func (encrypter *archiveEncrypter) encrypt(w io.Writer, r io.Reader) (err error) {
+	dataKey := make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return
+	}
+	header, err := encrypter.header(dataKey)
+	if err != nil {
+		return
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return
+	}
+	writer := bufio.NewWriter(w)
+	writer.Write(header)
+	nonce := make([]byte, aead.NonceSize())
+	chunk := make([]byte, archiveChunkSize)
+	next := make([]byte, archiveChunkSize)
+	n, err := io.ReadFull(r, chunk)
+	sealed := make([]byte, 4, 4+archiveChunkSize+aead.Overhead())
+	for index := uint64(0); ; index++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return
+		}
+		last := err != nil
+		m := 0
+		if !last {
+			// a full chunk is the last one when nothing follows it
+			m, err = io.ReadFull(r, next)
+			last = m == 0 && err == io.EOF
+		}
+		sealed = aead.Seal(sealed[:4], chunkNonce(nonce, index, last), chunk[:n], header)
+		binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+		_, err1 := writer.Write(sealed)
+		if err1 != nil {
+			return err1
+		}
+		if last {
+			break
+		}
+		chunk, next, n = next, chunk, m
+	}
+	return writer.Flush()
+}
+
+// archiveReader decrypts an archive chunk by chunk
+type archiveReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	index  uint64
+	plain  []byte
+	sealed []byte
+	done   bool
+}
+
+// NewDecryptReader returns the content of an archive encrypted with
+// SetArchiveKey(key), reads fail with ErrArchiveCorrupt when the archive
+// was modified or truncated
+func NewDecryptReader(r io.Reader, key []byte) (reader io.Reader, err error) {
+	return newArchiveReader(r, func(mode byte, header []byte, wrapped []byte) (dataKey []byte, err error) {
+		if mode != archiveModeKey {
+			return nil, errors.New("archive is encrypted to a public key")
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return
+		}
+		if len(wrapped) < aead.NonceSize() {
+			return nil, ErrArchiveCorrupt
+		}
+		dataKey, err = aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], header)
+		if err != nil {
+			err = ErrArchiveCorrupt
+		}
+		return
+	})
+}
+
+// NewDecryptReaderRSA returns the content of an archive encrypted with
+// SetArchivePublicKey to the public key of private
+func NewDecryptReaderRSA(r io.Reader, private *rsa.PrivateKey) (reader io.Reader, err error) {
+	return newArchiveReader(r, func(mode byte, header []byte, wrapped []byte) (dataKey []byte, err error) {
+		if mode != archiveModeRSA {
+			return nil, errors.New("archive is encrypted with a symmetric key")
+		}
+		dataKey, err = rsa.DecryptOAEP(sha256.New(), nil, private, wrapped, archiveLabel)
+		if err != nil {
+			err = ErrArchiveCorrupt
+		}
+		return
+	})
+}
+
+func newArchiveReader(r io.Reader, unwrap func(mode byte, header []byte, wrapped []byte) ([]byte, error)) (reader io.Reader, err error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(archiveMagic)+3)
+	_, err = io.ReadFull(br, header)
+	if err != nil || string(header[:len(archiveMagic)]) != string(archiveMagic) {
+		return nil, errors.New("not an encrypted archive")
+	}
+	mode := header[len(archiveMagic)]
+	wrapped := make([]byte, int(header[len(header)-2])<<8|int(header[len(header)-1]))
+	_, err = io.ReadFull(br, wrapped)
+	if err != nil {
+		return nil, ErrArchiveCorrupt
+	}
+	dataKey, err := unwrap(mode, header[:len(archiveMagic)+1], wrapped)
+	if err != nil {
+		return
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, ErrArchiveCorrupt
+	}
+	header = append(header, wrapped...)
+	return &archiveReader{r: br, aead: aead, header: header, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+func (reader *archiveReader) Read(p []byte) (n int, err error) {
+	for len(reader.plain) == 0 {
+		if reader.done {
+			return 0, io.EOF
+		}
+		err = reader.readChunk()
+		if err != nil {
+			return
+		}
+	}
+	n = copy(p, reader.plain)
+	reader.plain = reader.plain[n:]
+	return
+}
+
+func (reader *archiveReader) readChunk() (err error) {
+	var length [4]byte
+	_, err = io.ReadFull(reader.r, length[:])
+	if err != nil {
+		return ErrArchiveCorrupt
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > archiveChunkSize+uint32(reader.aead.Overhead()) {
+		return ErrArchiveCorrupt
+	}
+	if cap(reader.sealed) < int(size) {
+		reader.sealed = make([]byte, size)
+	}
+	sealed := reader.sealed[:size]
+	_, err = io.ReadFull(reader.r, sealed)
+	if err != nil {
+		return ErrArchiveCorrupt
+	}
+	// the chunk at the end of the archive must be the one sealed as last
+	_, err1 := reader.r.Peek(1)
+	last := err1 == io.EOF
+	plain, err := reader.aead.Open(sealed[:0], chunkNonce(reader.nonce, reader.index, last), sealed, reader.header)
+	if err != nil {
+		return ErrArchiveCorrupt
+	}
+	reader.done = last
+	reader.index++
+	reader.plain = plain
+	return nil
+}
+
+// archiveName returns the name a backup is kept under, fileName itself or
+// its encrypted archive
+func archiveName(fileName string) string {
+	if exist, _ := IsPathExists(fileName); !exist {
+		if exist, _ := IsPathExists(fileName + archiveSuffix); exist {
+			return fileName + archiveSuffix
+		}
+	}
+	return fileName
+}
+
+// backupExists tells whether a backup is kept under fileName, encrypted or
+// not
+func backupExists(fileName string) bool {
+	exist, _ := IsPathExists(fileName)
+	if !exist {
+		exist, _ = IsPathExists(fileName + archiveSuffix)
+	}
+	return exist
+}
+
+// trimArchiveSuffix returns the backup name of an archive
+func trimArchiveSuffix(fileName string) string {
+	return strings.TrimSuffix(fileName, archiveSuffix)
+}
+
+// loadPublicKey reads an RSA public key from a PEM file, in PKIX or PKCS#1
+// form
+func loadPublicKey(fileName string) (public *rsa.PublicKey, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(fileName + " has no PEM data")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return
+	}
+	public, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New(fileName + " is not an RSA public key")
+	}
+	return
+}
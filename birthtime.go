@@ -0,0 +1,67 @@
+package logging
+
+import "io/ioutil"
+import "os"
+import "path"
+import "strconv"
+import "strings"
+import "time"
+
+// the creation time is kept in a hidden file next to the log file when the
+// filesystem can not tell it, so rotation state survives a restart
+func birthtimeSidecar(fileName string) string {
+	return path.Join(path.Dir(fileName), "."+path.Base(fileName)+".birthtime")
+}
+
+func readBirthtime(fileName string) (t time.Time, ok bool) {
+	data, err := ioutil.ReadFile(birthtimeSidecar(fileName))
+	if err != nil {
+		return
+	}
+	nsec, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return
+	}
+	return time.Unix(0, nsec), true
+}
+
+func saveBirthtime(fileName string, t time.Time) (err error) {
+	_, ok, err := statBirthtime(fileName)
+	if err != nil {
+		return
+	}
+	if ok {
+		os.Remove(birthtimeSidecar(fileName))
+		return
+	}
+	// the sidecar gets the permissions of the log file
+	fileInfo, err := os.Stat(fileName)
+	if err != nil {
+		return
+	}
+	sidecar := birthtimeSidecar(fileName)
+	err = ioutil.WriteFile(sidecar, []byte(strconv.FormatInt(t.UnixNano(), 10)+"\n"), fileInfo.Mode().Perm())
+	if err != nil {
+		return
+	}
+	return os.Chmod(sidecar, fileInfo.Mode().Perm())
+}
+
+// GetBirthtime returns the creation time of a file, it falls back to the
+// time saved by the handler and then to the modification time
+func GetBirthtime(fileName string) (t time.Time, err error) {
+	fileInfo, err := os.Stat(fileName)
+	if err != nil {
+		return
+	}
+	t, ok, err := statBirthtime(fileName)
+	if err != nil || ok {
+		return
+	}
+	t, ok = readBirthtime(fileName)
+	if ok {
+		return
+	}
+	t = fileInfo.ModTime()
+	return
+}
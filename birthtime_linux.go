@@ -0,0 +1,100 @@
+//go:build linux
+// +build linux
+
+package logging
+
+import "runtime"
+import "syscall"
+import "time"
+import "unsafe"
+
+const (
+	atFdcwd    = -100
+	statxBtime = 0x800
+)
+
+type statxTimestamp struct {
+	Sec  int64
+	Nsec uint32
+	_    int32
+}
+
+type statxT struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	Uid            uint32
+	Gid            uint32
+	Mode           uint16
+	_              uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          statxTimestamp
+	Btime          statxTimestamp
+	Ctime          statxTimestamp
+	Mtime          statxTimestamp
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	MntId          uint64
+	_              [13]uint64 // the kernel fills all of struct statx, 256 bytes
+}
+
+// the syscall package does not export SYS_STATX on every architecture
+func statxTrap() (trap uintptr, ok bool) {
+	ok = true
+	switch runtime.GOARCH {
+	case "amd64":
+		trap = 332
+	case "386", "ppc64", "ppc64le":
+		trap = 383
+	case "arm":
+		trap = 397
+	case "arm64", "riscv64", "loong64":
+		trap = 291
+	case "s390x":
+		trap = 379
+	case "mips", "mipsle":
+		trap = 4366
+	case "mips64", "mips64le":
+		trap = 5326
+	default:
+		ok = false
+	}
+	return
+}
+
+// statBirthtime reads the btime of a file with statx(2), ok is false when the
+// kernel or the filesystem does not record it
+func statBirthtime(fileName string) (t time.Time, ok bool, err error) {
+	trap, ok := statxTrap()
+	if !ok {
+		return
+	}
+	p, err := syscall.BytePtrFromString(fileName)
+	if err != nil {
+		return
+	}
+	var stx statxT
+	dirfd := atFdcwd
+	_, _, errno := syscall.Syscall6(trap, uintptr(dirfd), uintptr(unsafe.Pointer(p)), 0, statxBtime, uintptr(unsafe.Pointer(&stx)), 0)
+	if errno == syscall.ENOSYS || errno == syscall.EPERM {
+		ok = false
+		return
+	}
+	if errno != 0 {
+		ok = false
+		err = errno
+		return
+	}
+	if stx.Mask&statxBtime == 0 {
+		ok = false
+		return
+	}
+	t = time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec))
+	return
+}
@@ -0,0 +1,14 @@
+//go:build linux
+// +build linux
+
+package logging
+
+import "testing"
+import "unsafe"
+
+func TestStatxSize(t *testing.T) {
+	// statx(2) writes the whole struct statx, a smaller buffer gets overrun
+	if size := unsafe.Sizeof(statxT{}); size != 256 {
+		t.Errorf("TestStatxSize statxT is %d bytes, want 256", size)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+package logging
+
+import "os"
+import "reflect"
+import "syscall"
+import "time"
+
+// statBirthtime reads the birth time recorded by BSD-like systems in
+// Stat_t.Birthtimespec, ok is false when the platform does not have it
+func statBirthtime(fileName string) (t time.Time, ok bool, err error) {
+	fileInfo, err := os.Stat(fileName)
+	if err != nil {
+		return
+	}
+	v := reflect.ValueOf(fileInfo.Sys())
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	field := v.Elem().FieldByName("Birthtimespec")
+	if !field.IsValid() {
+		return
+	}
+	ts, ok := field.Interface().(syscall.Timespec)
+	if !ok {
+		return
+	}
+	t = time.Unix(ts.Unix())
+	return
+}
@@ -0,0 +1,368 @@
+package logging
+
+import "bufio"
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "errors"
+import "hash"
+import "io"
+import "os"
+import "path"
+import "strconv"
+import "strings"
+
+// A hash chained log file starts with a header carrying the chain over from
+// the previous file:
+//
+//	#chain v1 alg=sha256 seq=1 prev=0000...
+//
+// and each record is written as
+//
+//	<seq> <prev> <hash> <record>
+//
+// where hash is the SHA-256, or HMAC-SHA256 with a key, of "<seq> <prev>
+// <record>" and prev is the hash of the previous record. Lines before the
+// first header are records written before the chain was set. A header with
+// truncated=1 follows a record cut by a crash and resumes the chain after
+// the last complete record
+const chainHeader = "#chain v1"
+
+const chainSHA256 = "sha256"
+const chainHMAC = "hmac-sha256"
+
+var chainGenesis = strings.Repeat("0", 2*sha256.Size)
+
+type hashChain struct {
+	key  []byte
+	seq  uint64 // sequence number of the last record
+	last string // hex hash of the last record
+}
+
+func (chain *hashChain) alg() string {
+	if chain.key != nil {
+		return chainHMAC
+	}
+	return chainSHA256
+}
+
+func newChainHash(key []byte) hash.Hash {
+	if key != nil {
+		return hmac.New(sha256.New, key)
+	}
+	return sha256.New()
+}
+
+func (chain *hashChain) header(truncated bool) []byte {
+	header := chainHeader + " alg=" + chain.alg() + " seq=" + strconv.FormatUint(chain.seq+1, 10) + " prev=" + chain.last
+	if truncated {
+		header += " truncated=1"
+	}
+	return []byte(header + "\n")
+}
+
+// seal turns a formatted record into a chained line, line breaks left in
+// the record are escaped so every record stays on one line
+func (chain *hashChain) seal(record []byte) []byte {
+	record = record[:len(record)-1]
+	if hasUnsafe(record) {
+		record = appendEscaped(nil, record, false)
+	}
+	chain.seq++
+	line := strconv.AppendUint(nil, chain.seq, 10)
+	line = append(line, ' ')
+	line = append(line, chain.last...)
+	line = append(line, ' ')
+	digest := chainDigest(chain.key, line, record)
+	line = append(line, digest...)
+	line = append(line, ' ')
+	line = append(line, record...)
+	chain.last = digest
+	return append(line, '\n')
+}
+
+// chainDigest hashes "<seq> <prev> <record>", prefix being "<seq> <prev> "
+func chainDigest(key []byte, prefix []byte, record []byte) string {
+	h := newChainHash(key)
+	h.Write(prefix)
+	h.Write(record)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// chainLine is a parsed line of a chained file
+type chainLine struct {
+	header    bool
+	truncated bool // the header follows a record cut by a crash
+	alg       string
+	seq       uint64
+	prev      string
+	hash      string
+	record    string
+}
+
+func parseChainLine(line string) (parsed chainLine, ok bool) {
+	if strings.HasPrefix(line, chainHeader+" ") {
+		parsed.header = true
+		for _, field := range strings.Fields(line[len(chainHeader):]) {
+			i := strings.IndexByte(field, '=')
+			if i < 0 {
+				return
+			}
+			switch field[:i] {
+			case "alg":
+				parsed.alg = field[i+1:]
+			case "seq":
+				seq, err := strconv.ParseUint(field[i+1:], 10, 64)
+				if err != nil || seq == 0 {
+					return
+				}
+				parsed.seq = seq
+			case "prev":
+				parsed.prev = field[i+1:]
+			case "truncated":
+				parsed.truncated = field[i+1:] == "1"
+			}
+		}
+		return parsed, parsed.seq > 0 && isChainHash(parsed.prev) && (parsed.alg == chainSHA256 || parsed.alg == chainHMAC)
+	}
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) != 4 {
+		return
+	}
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil || seq == 0 || !isChainHash(fields[1]) || !isChainHash(fields[2]) {
+		return
+	}
+	return chainLine{seq: seq, prev: fields[1], hash: fields[2], record: fields[3]}, true
+}
+
+func isChainHash(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// readLastLine returns the last complete line of a file, without its
+// newline, partial tells that a line without a newline follows it
+func readLastLine(fileName string) (line string, partial bool, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	size := info.Size()
+	for window := int64(4096); ; window *= 2 {
+		if window > size {
+			window = size
+		}
+		data := make([]byte, window)
+		_, err = file.ReadAt(data, size-window)
+		if err != nil && err != io.EOF {
+			return
+		}
+		err = nil
+		text := string(data)
+		partial = size > 0 && !strings.HasSuffix(text, "\n")
+		end := strings.LastIndexByte(text, '\n')
+		if end < 0 {
+			if window == size {
+				return "", partial, nil
+			}
+			continue
+		}
+		text = text[:end]
+		if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+			return text[i+1:], partial, nil
+		}
+		if window == size {
+			return text, partial, nil
+		}
+	}
+}
+
+// SetHashChain makes the handler write a tamper evident audit log: each
+// record carries a sequence number, the SHA-256 of the previous record and
+// its own, an HMAC-SHA256 when key is given. The chain goes on from the
+// last record of the current file and across rotations through a header
+// at the top of each new file. A record cut by a crash at the end of the
+// file is closed and the chain resumes after the last complete record.
+// Check the files with VerifyChain
+func (handler *BasicHandler) SetHashChain(key []byte) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if handler.logConfig.fileName == "" {
+		err = errors.New("a hash chain needs a log file")
+		return
+	}
+	if key != nil && len(key) == 0 {
+		err = errors.New("HMAC key can't be empty")
+		return
+	}
+	err = handler.flushOut()
+	if err != nil {
+		return
+	}
+	chain := &hashChain{key: key, last: chainGenesis}
+	line, partial, err := readLastLine(path.Join(handler.logConfig.fileDir, handler.logConfig.fileName))
+	if err != nil {
+		return
+	}
+	parsed, ok := parseChainLine(line)
+	if ok && parsed.header && parsed.alg != chain.alg() {
+		err = errors.New(handler.logConfig.fileName + " is chained with " + parsed.alg)
+		return
+	}
+	if ok && parsed.header {
+		chain.seq, chain.last = parsed.seq-1, parsed.prev
+	} else if ok {
+		chain.seq, chain.last = parsed.seq, parsed.hash
+	}
+	handler.chain = chain
+	if !ok || partial {
+		// records written before the chain was set are not part of it
+		if file := handler.currentFile(); file != nil {
+			header := chain.header(partial)
+			if partial {
+				header = append([]byte{'\n'}, header...)
+			}
+			_, err = file.Write(header)
+		}
+	}
+	return
+}
+
+// startChainFile writes the header to a new file opened by a rotation
+func (handler *BasicHandler) startChainFile(file *os.File) (err error) {
+	info, err := file.Stat()
+	if err != nil || info.Size() > 0 {
+		return
+	}
+	_, err = file.Write(handler.chain.header(false))
+	return
+}
+
+// sealRecord chains a formatted record when the handler has a hash chain
+func (handler *BasicHandler) sealRecord(buf []byte) []byte {
+	if handler.chain == nil {
+		return buf
+	}
+	return handler.chain.seal(buf)
+}
+
+// ChainError tells where VerifyChain found a chain broken
+type ChainError struct {
+	File   string
+	Line   int
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return e.File + ":" + strconv.Itoa(e.Line) + ": " + e.Reason
+}
+
+// VerifyChain checks files written with SetHashChain(nil), oldest first,
+// and returns a *ChainError for the first gap or modification found
+func VerifyChain(files ...string) error {
+	return verifyChain(nil, files)
+}
+
+// VerifyChainHMAC checks files written with SetHashChain(key), oldest
+// first, and returns a *ChainError for the first gap or modification found
+func VerifyChainHMAC(key []byte, files ...string) error {
+	if len(key) == 0 {
+		return errors.New("HMAC key can't be empty")
+	}
+	return verifyChain(key, files)
+}
+
+func verifyChain(key []byte, files []string) (err error) {
+	alg := chainSHA256
+	if key != nil {
+		alg = chainHMAC
+	}
+	started := false
+	var seq uint64
+	last := ""
+	cut := 0 // line of a record which may only be followed by a truncated=1 header
+	var unchained *ChainError
+	for _, fileName := range files {
+		file, err1 := os.Open(fileName)
+		if err1 != nil {
+			return err1
+		}
+		reader := bufio.NewReader(file)
+		lineNo := 0
+		for {
+			text, err1 := reader.ReadString('\n')
+			if err1 != nil && err1 != io.EOF {
+				file.Close()
+				return err1
+			}
+			if text == "" {
+				break
+			}
+			lineNo++
+			fail := func(reason string) error {
+				file.Close()
+				return &ChainError{File: fileName, Line: lineNo, Reason: reason}
+			}
+			if !strings.HasSuffix(text, "\n") {
+				return fail("truncated record")
+			}
+			parsed, ok := parseChainLine(text[:len(text)-1])
+			if cut > 0 {
+				if !ok || !parsed.header || !parsed.truncated {
+					lineNo = cut
+					return fail("not a chained record")
+				}
+				cut = 0
+			}
+			if !ok && !started {
+				// written before the chain was set
+				if unchained == nil {
+					unchained = &ChainError{File: fileName, Line: lineNo, Reason: "not a chained record"}
+				}
+				continue
+			}
+			if !ok {
+				cut = lineNo
+				continue
+			}
+			if parsed.header {
+				if parsed.alg != alg {
+					return fail("chain uses " + parsed.alg + ", not " + alg)
+				}
+				if started && (parsed.seq != seq+1 || parsed.prev != last) {
+					return fail("header doesn't continue the previous file, records are missing")
+				}
+				started, seq, last = true, parsed.seq-1, parsed.prev
+				continue
+			}
+			if started && parsed.seq != seq+1 {
+				return fail("sequence gap, expected " + strconv.FormatUint(seq+1, 10) + " got " + strconv.FormatUint(parsed.seq, 10))
+			}
+			if started && parsed.prev != last {
+				return fail("previous hash mismatch, the previous record was modified")
+			}
+			prefix := strconv.FormatUint(parsed.seq, 10) + " " + parsed.prev + " "
+			if chainDigest(key, []byte(prefix), []byte(parsed.record)) != parsed.hash {
+				return fail("record " + strconv.FormatUint(parsed.seq, 10) + " was modified")
+			}
+			started, seq, last = true, parsed.seq, parsed.hash
+		}
+		file.Close()
+		if cut > 0 {
+			return &ChainError{File: fileName, Line: cut, Reason: "not a chained record"}
+		}
+	}
+	if !started && unchained != nil {
+		return unchained
+	}
+	return
+}
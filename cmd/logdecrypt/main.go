@@ -0,0 +1,115 @@
+// logdecrypt writes the content of log backups encrypted by a handler to
+// stdout:
+//
+//	logdecrypt -key 000102...1f app.log.1.enc app.log.2.enc
+//	logdecrypt -private-key archive.pem < app.log.2024-01-02.enc
+package main
+
+import "crypto/rsa"
+import "crypto/x509"
+import "encoding/hex"
+import "encoding/pem"
+import "errors"
+import "flag"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+
+import "github.com/y851592226/logging"
+
+func main() {
+	hexKey := flag.String("key", "", "hex encoded AES key given to SetArchiveKey")
+	privateKeyFile := flag.String("private-key", "", "PEM file of the RSA private key matching SetArchivePublicKey")
+	flag.Parse()
+	if (*hexKey == "") == (*privateKeyFile == "") {
+		fmt.Fprintln(os.Stderr, "logdecrypt: give one of -key or -private-key")
+		flag.Usage()
+		os.Exit(2)
+	}
+	decrypt, err := getDecrypter(*hexKey, *privateKeyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "logdecrypt:", err)
+		os.Exit(1)
+	}
+	if flag.NArg() == 0 {
+		err = decrypt(os.Stdout, os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "logdecrypt:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	for _, fileName := range flag.Args() {
+		err = decryptFile(decrypt, fileName)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "logdecrypt:", fileName+":", err)
+			os.Exit(1)
+		}
+	}
+}
+
+type decrypter func(w io.Writer, r io.Reader) error
+
+func getDecrypter(hexKey, privateKeyFile string) (decrypt decrypter, err error) {
+	var newReader func(r io.Reader) (io.Reader, error)
+	if hexKey != "" {
+		key, err1 := hex.DecodeString(hexKey)
+		if err1 != nil {
+			return nil, err1
+		}
+		newReader = func(r io.Reader) (io.Reader, error) {
+			return logging.NewDecryptReader(r, key)
+		}
+	} else {
+		private, err1 := loadPrivateKey(privateKeyFile)
+		if err1 != nil {
+			return nil, err1
+		}
+		newReader = func(r io.Reader) (io.Reader, error) {
+			return logging.NewDecryptReaderRSA(r, private)
+		}
+	}
+	decrypt = func(w io.Writer, r io.Reader) (err error) {
+		reader, err := newReader(r)
+		if err != nil {
+			return
+		}
+		_, err = io.Copy(w, reader)
+		return
+	}
+	return
+}
+
+func decryptFile(decrypt decrypter, fileName string) (err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	return decrypt(os.Stdout, file)
+}
+
+// loadPrivateKey reads an RSA private key in PKCS#1 or PKCS#8 PEM form
+func loadPrivateKey(fileName string) (private *rsa.PrivateKey, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(fileName + " has no PEM data")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return
+	}
+	private, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New(fileName + " is not an RSA private key")
+	}
+	return
+}
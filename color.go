@@ -0,0 +1,163 @@
+package logging
+
+import "errors"
+import "os"
+import "strings"
+
+// ColorMode tells a handler when to write ANSI colors
+type ColorMode int
+
+const (
+	ColorAuto   ColorMode = iota // only on a terminal, following NO_COLOR and FORCE_COLOR
+	ColorAlways                  // even when the output is a file or a pipe
+	ColorNever
+)
+
+// Palette holds the ANSI escape sequences a colored handler writes
+type Palette struct {
+	Debug   string
+	Warning string
+	Error   string
+	Time    string // for the time tokens
+	Name    string // for the logger name
+}
+
+// DefaultPalette is used by colored handlers without a palette of their own
+var DefaultPalette = Palette{
+	Debug:   "\x1b[36m",
+	Warning: "\x1b[33m",
+	Error:   "\x1b[31m",
+	Time:    "\x1b[2m",
+	Name:    "\x1b[1;35m",
+}
+
+const colorReset = "\x1b[0m"
+
+func (palette *Palette) level(logLevel LogLevel) string {
+	switch logLevel {
+	case DEBUG:
+		return palette.Debug
+	case WARNING:
+		return palette.Warning
+	default:
+		return palette.Error
+	}
+}
+
+// timeTokens are dimmed by colored handlers
+var timeTokens = map[string]bool{
+	"date":        true,
+	"unixTime":    true,
+	"dateTime":    true,
+	"nanoSecond":  true,
+	"ascTime":     true,
+	"msecs":       true,
+	"microSecond": true,
+	"isoTime":     true,
+	"utcTime":     true,
+	"time":        true,
+}
+
+// colorTokens switch colors by hand, they write nothing when the handler is
+// not colored
+var colorTokens = map[string]bool{
+	"color": true,
+	"reset": true,
+}
+
+// colorToken returns %(color), the color of the record level, or %(reset)
+func colorToken(name string, palette *Palette) formatToken {
+	if palette == nil {
+		return func(buf []byte, r *Record) []byte {
+			return buf
+		}
+	}
+	if name == "reset" {
+		return func(buf []byte, r *Record) []byte {
+			return append(buf, colorReset...)
+		}
+	}
+	return func(buf []byte, r *Record) []byte {
+		return append(buf, palette.level(r.Level)...)
+	}
+}
+
+// colorize paints the level name, the time tokens and the logger name of a
+// format string without %(color), the escapes are put around the padded
+// value so they don't count in its width
+func colorize(name string, token formatToken, palette *Palette) formatToken {
+	if i := strings.IndexByte(name, ':'); i > 0 {
+		name = name[:i]
+	}
+	color := ""
+	switch {
+	case name == "levelName":
+		return func(buf []byte, r *Record) []byte {
+			buf = append(buf, palette.level(r.Level)...)
+			buf = token(buf, r)
+			return append(buf, colorReset...)
+		}
+	case name == "name":
+		color = palette.Name
+	case timeTokens[name]:
+		color = palette.Time
+	}
+	if color == "" {
+		return token
+	}
+	return func(buf []byte, r *Record) []byte {
+		buf = append(buf, color...)
+		buf = token(buf, r)
+		return append(buf, colorReset...)
+	}
+}
+
+// useColor resolves the color mode of the handler against its output and
+// the NO_COLOR and FORCE_COLOR environment variables
+func (handler *BasicHandler) useColor() bool {
+	switch handler.colorMode {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	if force := os.Getenv("FORCE_COLOR"); force != "" {
+		return force != "0" && force != "false"
+	}
+	file, ok := handler.out.(*os.File)
+	return ok && isTerminal(file.Fd())
+}
+
+// SetColor sets when the handler writes ANSI colors, by default ColorAuto
+// colors a handler writing to a terminal
+func (handler *BasicHandler) SetColor(mode ColorMode) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if mode < ColorAuto || mode > ColorNever {
+		err = errors.New("error color mode")
+		return
+	}
+	oldMode := handler.colorMode
+	handler.colorMode = mode
+	err = handler.setFormatter()
+	if err != nil {
+		handler.colorMode = oldMode
+	}
+	return
+}
+
+// SetPalette replaces DefaultPalette for this handler
+func (handler *BasicHandler) SetPalette(palette Palette) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	oldPalette := handler.palette
+	handler.palette = &palette
+	err = handler.setFormatter()
+	if err != nil {
+		handler.palette = oldPalette
+	}
+	return
+}
@@ -1,8 +1,12 @@
 package logging
 
+import "encoding/hex"
 import "errors"
 import "fmt"
+import "sort"
 import "strconv"
+import "strings"
+import "time"
 
 type LogConfig struct {
 	fileDir      string
@@ -94,11 +98,8 @@ var TimeRotatingHandlerConfig = map[string]string{
 	"backupCount":  "30",
 }
 
-func getBasicHandler(conf map[string]string) (handler1 LogHandler, err error) {
-	handler, err := GetBasicHandler(conf["fileDir"], conf["fileName"])
-	if err != nil {
-		return
-	}
+// setBasicConfig applies the options shared by every handler type
+func setBasicConfig(handler *BasicHandler, conf map[string]string) (err error) {
 	if formatString, ok := conf["formatString"]; ok {
 		err = handler.SetFormatString(formatString)
 		if err != nil {
@@ -120,36 +121,314 @@ func getBasicHandler(conf map[string]string) (handler1 LogHandler, err error) {
 			return
 		}
 	}
-	handler1 = handler
+	if stackLevel, ok := conf["stackLevel"]; ok {
+		switch stackLevel {
+		case "DEBUG":
+			err = handler.SetStackLevel(DEBUG)
+		case "WARNING":
+			err = handler.SetStackLevel(WARNING)
+		case "ERROR":
+			err = handler.SetStackLevel(ERROR)
+		case "NONE":
+			err = handler.SetStackLevel(noLevel)
+		default:
+			err = errors.New(fmt.Sprintf("err format of stackLevel %s", stackLevel))
+		}
+		if err != nil {
+			return
+		}
+	}
+	if timeLayout, ok := conf["timeLayout"]; ok {
+		err = handler.SetTimeLayout(timeLayout)
+		if err != nil {
+			return
+		}
+	}
+	if timeZone, ok := conf["timeZone"]; ok {
+		location, err1 := time.LoadLocation(timeZone)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		err = handler.SetTimeLocation(location)
+		if err != nil {
+			return
+		}
+	}
+	if encoder, ok := conf["encoder"]; ok {
+		switch encoder {
+		case "text":
+			err = handler.SetEncoder(nil)
+		case "logfmt":
+			err = handler.SetEncoder(&LogfmtEncoder{TimeLayout: conf["timeLayout"]})
+		case "gelf":
+			err = handler.SetEncoder(&GELFEncoder{Host: conf["host"]})
+		case "ecs":
+			err = handler.SetEncoder(&ECSEncoder{})
+		default:
+			err = errors.New(fmt.Sprintf("err format of encoder %s", encoder))
+		}
+		if err != nil {
+			return
+		}
+	}
+	if multiline, ok := conf["multiline"]; ok {
+		switch multiline {
+		case "escape":
+			err = handler.SetMultilinePolicy(MultilineEscape)
+		case "indent":
+			err = handler.SetMultilinePolicy(MultilineIndent)
+		case "encode":
+			err = handler.SetMultilinePolicy(MultilineEncode)
+		case "raw":
+			err = handler.SetMultilinePolicy(MultilineRaw)
+		default:
+			err = errors.New(fmt.Sprintf("err format of multiline %s", multiline))
+		}
+		if err != nil {
+			return
+		}
+	}
+	err = setRedactConfig(handler, conf)
+	if err != nil {
+		return
+	}
+	err = setHashChainConfig(handler, conf)
+	if err != nil {
+		return
+	}
+	err = setArchiveConfig(handler, conf)
+	if err != nil {
+		return
+	}
+	if color, ok := conf["color"]; ok {
+		switch color {
+		case "auto":
+			err = handler.SetColor(ColorAuto)
+		case "always":
+			err = handler.SetColor(ColorAlways)
+		case "never":
+			err = handler.SetColor(ColorNever)
+		default:
+			err = errors.New(fmt.Sprintf("err format of color %s", color))
+		}
+		if err != nil {
+			return
+		}
+	}
+	if minFreeSpace, ok := conf["minFreeSpace"]; ok {
+		size, err1 := strconv.ParseInt(minFreeSpace, 10, 64)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		err = handler.SetMinFreeSpace(size)
+		if err != nil {
+			return
+		}
+	}
+	if bufferSize, ok := conf["bufferSize"]; ok {
+		size, err1 := strconv.Atoi(bufferSize)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		err = handler.SetBufferSize(size)
+		if err != nil {
+			return
+		}
+	}
+	if flushInterval, ok := conf["flushInterval"]; ok {
+		interval, err1 := time.ParseDuration(flushInterval)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		err = handler.SetFlushInterval(interval)
+		if err != nil {
+			return
+		}
+	}
+	if flushOnError, ok := conf["flushOnError"]; ok {
+		flush, err1 := strconv.ParseBool(flushOnError)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		err = handler.SetFlushOnError(flush)
+		if err != nil {
+			return
+		}
+	}
+	if syncPolicy, ok := conf["syncPolicy"]; ok {
+		switch syncPolicy {
+		case "never":
+			err = handler.SetSyncPolicy(SyncNever)
+		case "record":
+			err = handler.SetSyncPolicy(SyncEachRecord)
+		case "interval":
+			err = handler.SetSyncPolicy(SyncInterval)
+		case "rotate":
+			err = handler.SetSyncPolicy(SyncOnRotate)
+		default:
+			err = errors.New(fmt.Sprintf("err format of syncPolicy %s", syncPolicy))
+		}
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
-func getRotatingHandler(conf map[string]string) (handler1 LogHandler, err error) {
-	handler, err := GetRotatingHandler(conf["fileDir"], conf["fileName"])
+// getPermissionConfig reads fileMode and dirMode, octal such as "0640", and
+// owner and group, names or ids. They are given to the constructor so the
+// log file is created with them
+func getPermissionConfig(conf map[string]string) (perm Permissions, err error) {
+	perm = DefaultPermissions()
+	if fileMode, ok := conf["fileMode"]; ok {
+		perm.FileMode, err = parseMode(fileMode)
+		if err != nil {
+			return
+		}
+	}
+	if dirMode, ok := conf["dirMode"]; ok {
+		perm.DirMode, err = parseMode(dirMode)
+		if err != nil {
+			return
+		}
+	}
+	perm.Uid, err = lookupOwner(conf["owner"], false)
 	if err != nil {
 		return
 	}
-	if formatString, ok := conf["formatString"]; ok {
-		err = handler.SetFormatString(formatString)
+	perm.Gid, err = lookupOwner(conf["group"], true)
+	return
+}
+
+// setHashChainConfig turns the hash chain on when hashChain is true or a
+// hex encoded hashChainKey is given
+func setHashChainConfig(handler *BasicHandler, conf map[string]string) (err error) {
+	enabled := false
+	if hashChain, ok := conf["hashChain"]; ok {
+		enabled, err = strconv.ParseBool(hashChain)
 		if err != nil {
 			return
 		}
 	}
-	if logLevel, ok := conf["logLevel"]; ok {
-		switch logLevel {
-		case "DEBUG":
-			err = handler.SetLogLevel(DEBUG)
-		case "WARNING":
-			err = handler.SetLogLevel(WARNING)
-		case "ERROR":
-			err = handler.SetLogLevel(ERROR)
-		default:
-			err = errors.New(fmt.Sprintf("err format or logLevel %s", logLevel))
+	var key []byte
+	if hexKey, ok := conf["hashChainKey"]; ok {
+		enabled = true
+		key, err = hex.DecodeString(hexKey)
+		if err != nil {
+			return
+		}
+	}
+	if enabled {
+		err = handler.SetHashChain(key)
+	}
+	return
+}
+
+// setArchiveConfig encrypts the backups with a hex encoded archiveKey or to
+// the RSA public key in the PEM file archivePublicKey
+func setArchiveConfig(handler *BasicHandler, conf map[string]string) (err error) {
+	hexKey, hasKey := conf["archiveKey"]
+	publicKeyFile, hasPublicKey := conf["archivePublicKey"]
+	if hasKey && hasPublicKey {
+		err = errors.New("archiveKey and archivePublicKey can't be used together")
+		return
+	}
+	if hasKey {
+		key, err1 := hex.DecodeString(hexKey)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		err = handler.SetArchiveKey(key)
+	}
+	if hasPublicKey {
+		public, err1 := loadPublicKey(publicKeyFile)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		err = handler.SetArchivePublicKey(public)
+	}
+	return
+}
+
+// setRedactConfig turns redaction on when redact is true or when keys or
+// patterns are given. redactKeys is a comma separated list of field names,
+// each redactPattern.<name> adds a regular expression, applied in the order
+// of the names as a map has no order
+func setRedactConfig(handler *BasicHandler, conf map[string]string) (err error) {
+	enabled := false
+	if redact, ok := conf["redact"]; ok {
+		enabled, err = strconv.ParseBool(redact)
+		if err != nil {
+			return
 		}
+	}
+	redactor := NewRedactor()
+	if keys, ok := conf["redactKeys"]; ok {
+		enabled = true
+		for _, key := range strings.Split(keys, ",") {
+			err = redactor.AddKey(strings.TrimSpace(key))
+			if err != nil {
+				return
+			}
+		}
+	}
+	names := []string{}
+	for key := range conf {
+		if strings.HasPrefix(key, "redactPattern.") {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	for _, key := range names {
+		enabled = true
+		err = redactor.AddPattern(strings.TrimPrefix(key, "redactPattern."), conf[key])
 		if err != nil {
 			return
 		}
 	}
+	if enabled {
+		err = handler.SetRedactor(redactor)
+	}
+	return
+}
+
+func getBasicHandler(conf map[string]string) (handler1 LogHandler, err error) {
+	perm, err := getPermissionConfig(conf)
+	if err != nil {
+		return
+	}
+	handler, err := GetBasicHandlerWithPermissions(conf["fileDir"], conf["fileName"], perm)
+	if err != nil {
+		return
+	}
+	err = setBasicConfig(handler, conf)
+	if err != nil {
+		return
+	}
+	handler1 = handler
+	return
+}
+
+func getRotatingHandler(conf map[string]string) (handler1 LogHandler, err error) {
+	perm, err := getPermissionConfig(conf)
+	if err != nil {
+		return
+	}
+	handler, err := GetRotatingHandlerWithPermissions(conf["fileDir"], conf["fileName"], perm)
+	if err != nil {
+		return
+	}
+	err = setBasicConfig(&handler.BasicHandler, conf)
+	if err != nil {
+		return
+	}
 	if maxFileSize, ok := conf["maxFileSize"]; ok {
 		size, err1 := strconv.ParseInt(maxFileSize, 10, 64)
 		if err1 != nil {
@@ -173,49 +452,103 @@ func getRotatingHandler(conf map[string]string) (handler1 LogHandler, err error)
 			return
 		}
 	}
+	if rotateOnStartup, ok := conf["rotateOnStartup"]; ok {
+		rotate, err1 := strconv.ParseBool(rotateOnStartup)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		err = handler.SetRotateOnStartup(rotate)
+		if err != nil {
+			return
+		}
+	}
 	handler1 = handler
 	return
 }
 
 func getTimeRotatingHandler(conf map[string]string) (handler1 LogHandler, err error) {
-	handler, err := GetTimeRotatingHandler(conf["fileDir"], conf["fileName"])
+	perm, err := getPermissionConfig(conf)
 	if err != nil {
 		return
 	}
-	if formatString, ok := conf["formatString"]; ok {
-		err = handler.SetFormatString(formatString)
+	handler, err := GetTimeRotatingHandlerWithPermissions(conf["fileDir"], conf["fileName"], perm)
+	if err != nil {
+		return
+	}
+	err = setBasicConfig(&handler.BasicHandler, conf)
+	if err != nil {
+		return
+	}
+	if when, ok := conf["when"]; ok {
+		err = handler.SetWhen(when)
 		if err != nil {
 			return
 		}
 	}
-	if logLevel, ok := conf["logLevel"]; ok {
-		switch logLevel {
-		case "DEBUG":
-			err = handler.SetLogLevel(DEBUG)
-		case "WARNING":
-			err = handler.SetLogLevel(WARNING)
-		case "ERROR":
-			err = handler.SetLogLevel(ERROR)
-		default:
-			err = errors.New(fmt.Sprintf("err format or logLevel %s", logLevel))
+	if backupCount, ok := conf["backupCount"]; ok {
+		count, err1 := strconv.Atoi(backupCount)
+		if err1 != nil {
+			err = err1
+			return
 		}
+		err = handler.SetBackupCount(count)
 		if err != nil {
 			return
 		}
 	}
-	if when, ok := conf["when"]; ok {
-		err = handler.SetWhen(when)
+	if rotateOnStartup, ok := conf["rotateOnStartup"]; ok {
+		rotate, err1 := strconv.ParseBool(rotateOnStartup)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		err = handler.SetRotateOnStartup(rotate)
 		if err != nil {
 			return
 		}
 	}
-	if backupCount, ok := conf["backupCount"]; ok {
-		count, err1 := strconv.Atoi(backupCount)
+	handler1 = handler
+	return
+}
+
+func getGELFHandler(conf map[string]string) (handler1 LogHandler, err error) {
+	handler, err := GetGELFHandler(conf["address"])
+	if err != nil {
+		return
+	}
+	err = setBasicConfig(&handler.BasicHandler, conf)
+	if err != nil {
+		return
+	}
+	if host, ok := conf["host"]; ok && conf["encoder"] == "" {
+		err = handler.SetEncoder(&GELFEncoder{Host: host})
+		if err != nil {
+			return
+		}
+	}
+	if chunkSize, ok := conf["chunkSize"]; ok {
+		size, err1 := strconv.Atoi(chunkSize)
 		if err1 != nil {
 			err = err1
 			return
 		}
-		err = handler.SetBackupCount(count)
+		err = handler.SetChunkSize(size)
+		if err != nil {
+			return
+		}
+	}
+	if compression, ok := conf["compression"]; ok {
+		switch compression {
+		case "none":
+			err = handler.SetCompression(GELFCompressNone)
+		case "gzip":
+			err = handler.SetCompression(GELFCompressGzip)
+		case "zlib":
+			err = handler.SetCompression(GELFCompressZlib)
+		default:
+			err = errors.New(fmt.Sprintf("err format of compression %s", compression))
+		}
 		if err != nil {
 			return
 		}
@@ -232,6 +565,8 @@ func getHandler(conf map[string]string) (handler LogHandler, err error) {
 		return getRotatingHandler(conf)
 	case "TimeRotatingHandler":
 		return getTimeRotatingHandler(conf)
+	case "GELFHandler":
+		return getGELFHandler(conf)
 	default:
 		return nil, errors.New(fmt.Sprintf("err format of handlerType %s", conf["handlerType"]))
 	}
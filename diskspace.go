@@ -0,0 +1,58 @@
+package logging
+
+import "errors"
+import "fmt"
+import "time"
+
+// diskCheckInterval is how often a handler with a free space threshold asks
+// the filesystem for the available space
+var diskCheckInterval = time.Second
+
+// SetMinFreeSpace sets the free space threshold of the filesystem holding the
+// log file. 0 disables the guard, otherwise the handler degrades in tiers:
+//
+//	free >= size             every record is written
+//	size/2 <= free < size    WARNING and ERROR records only, DEBUG is dropped
+//	free < size/2            ERROR records only
+//
+// One warning goes to the error handler when the handler leaves the first
+// tier, all records are written again once the space is back
+func (handler *BasicHandler) SetMinFreeSpace(size int64) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if size < 0 {
+		err = errors.New("size can't be a negative number")
+		return
+	}
+	handler.minFreeSpace = size
+	handler.diskLevel = DEBUG
+	handler.diskCheckTime = time.Time{}
+	return
+}
+
+// checkDiskSpace tells whether a record of logLevel may be written given the
+// free space left, a warning is reported once each time logging degrades
+func (handler *BasicHandler) checkDiskSpace(logLevel LogLevel) bool {
+	if handler.minFreeSpace <= 0 || handler.logConfig.fileName == "" {
+		return true
+	}
+	now := time.Now()
+	if now.After(handler.diskCheckTime) {
+		handler.diskCheckTime = now.Add(diskCheckInterval)
+		free, ok := freeSpace(handler.logConfig.fileDir)
+		if ok {
+			level := DEBUG
+			if free < handler.minFreeSpace/2 {
+				level = ERROR
+			} else if free < handler.minFreeSpace {
+				level = WARNING
+			}
+			if level > DEBUG && handler.diskLevel == DEBUG {
+				handler.reportError(fmt.Errorf("free space of %s is %d bytes, below %d, dropping records below %s",
+					handler.logConfig.fileDir, free, handler.minFreeSpace, level))
+			}
+			handler.diskLevel = level
+		}
+	}
+	return logLevel >= handler.diskLevel
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!dragonfly
+
+package logging
+
+// freeSpace is not supported here, the disk space guard stays disabled
+func freeSpace(dir string) (free int64, ok bool) {
+	return
+}
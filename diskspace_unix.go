@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package logging
+
+import "syscall"
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem holding dir
+func freeSpace(dir string) (free int64, ok bool) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return
+	}
+	return int64(uint64(stat.Bavail) * uint64(stat.Bsize)), true
+}
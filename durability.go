@@ -0,0 +1,189 @@
+package logging
+
+import "bufio"
+import "errors"
+import "os"
+import "time"
+
+type SyncPolicy int
+
+const (
+	SyncNever SyncPolicy = iota
+	SyncEachRecord
+	SyncInterval
+	SyncOnRotate
+)
+
+// handlerOut lets the buffer follow the file of the handler across reopens
+// and rotations
+type handlerOut struct {
+	handler *BasicHandler
+}
+
+// Write is only called by the buffer to flush the buffered records, those
+// not written go to the fallback as the buffer drops them on reopen
+func (out handlerOut) Write(p []byte) (n int, err error) {
+	handler := out.handler
+	n, err = handler.out.Write(p)
+	if err != nil {
+		handler.failedWrites += int64(handler.buffered)
+		if handler.fallback != nil {
+			handler.fallback.Write(p[n:])
+		}
+	}
+	handler.buffered = 0
+	return
+}
+
+type syncer interface {
+	Sync() error
+}
+
+// SetBufferSize buffers up to size bytes in memory before they are written
+// to the log file, 0 writes every record straight away
+func (handler *BasicHandler) SetBufferSize(size int) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if size < 0 {
+		err = errors.New("size can't be a negative number")
+		return
+	}
+	err = handler.flushOut()
+	if size == 0 {
+		handler.buffer = nil
+	} else {
+		handler.buffer = bufio.NewWriterSize(handlerOut{handler}, size)
+	}
+	return
+}
+
+// SetFlushInterval flushes the buffer every interval, and syncs the log file
+// when the sync policy is SyncInterval. 0 disables the timer
+func (handler *BasicHandler) SetFlushInterval(interval time.Duration) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if interval < 0 {
+		err = errors.New("interval can't be a negative number")
+		return
+	}
+	if handler.flushTimer != nil {
+		handler.flushTimer.Stop()
+		handler.flushTimer = nil
+	}
+	handler.flushInterval = interval
+	if interval > 0 && !handler.closed {
+		handler.flushTimer = time.AfterFunc(interval, handler.periodicFlush)
+	}
+	return
+}
+
+// SetFlushOnError flushes the buffer after every ERROR record
+func (handler *BasicHandler) SetFlushOnError(flush bool) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.flushOnError = flush
+	return
+}
+
+// SetSyncPolicy sets when the log file is fsynced: never, after each record,
+// every flush interval or before the file is rotated or closed
+func (handler *BasicHandler) SetSyncPolicy(policy SyncPolicy) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if policy < SyncNever || policy > SyncOnRotate {
+		err = errors.New("error sync policy")
+		return
+	}
+	handler.syncPolicy = policy
+	return
+}
+
+// Flush writes the buffered records to the log file, it returns the error
+// which broke the handler until the file is reopened
+func (handler *BasicHandler) Flush() (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if handler.closed {
+		return ErrHandlerClosed
+	}
+	if handler.broken {
+		return handler.brokenErr
+	}
+	err = handler.flushOut()
+	if err != nil {
+		handler.setBroken(err)
+	}
+	return
+}
+
+// Sync writes the buffered records to the log file and commits the file to
+// stable storage, it returns the error which broke the handler until the
+// file is reopened
+func (handler *BasicHandler) Sync() (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if handler.closed {
+		return ErrHandlerClosed
+	}
+	if handler.broken {
+		return handler.brokenErr
+	}
+	err = handler.flushOut()
+	if err == nil {
+		err = handler.syncOut()
+	}
+	if err != nil {
+		handler.setBroken(err)
+	}
+	return
+}
+
+func (handler *BasicHandler) flushOut() (err error) {
+	if handler.buffer == nil || handler.broken || handler.closed {
+		return
+	}
+	return handler.buffer.Flush()
+}
+
+func (handler *BasicHandler) syncOut() (err error) {
+	if handler.logConfig.fileName == "" || handler.broken || handler.closed {
+		return
+	}
+	if out, ok := handler.out.(syncer); ok {
+		err = out.Sync()
+	}
+	return
+}
+
+// closeOut flushes and closes the current log file before it is reopened,
+// rotated or the handler is closed
+func (handler *BasicHandler) closeOut() {
+	if handler.out == nil {
+		return
+	}
+	err := handler.flushOut()
+	if err == nil && handler.syncPolicy != SyncNever {
+		err = handler.syncOut()
+	}
+	handler.reportError(err)
+	if handler.out != os.Stdout {
+		handler.out.Close()
+	}
+}
+
+func (handler *BasicHandler) periodicFlush() {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if handler.closed || handler.flushTimer == nil {
+		return
+	}
+	err := handler.flushOut()
+	if err == nil && handler.syncPolicy == SyncInterval {
+		err = handler.syncOut()
+	}
+	if err != nil {
+		handler.setBroken(err)
+		handler.reportError(err)
+	}
+	handler.flushTimer.Reset(handler.flushInterval)
+}
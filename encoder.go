@@ -0,0 +1,64 @@
+package logging
+
+import "strconv"
+
+// Encoder replaces the format string of a handler, Encode appends one
+// record to buf without the trailing newline
+type Encoder interface {
+	Encode(buf []byte, r *Record) []byte
+}
+
+// SetEncoder makes the handler write its records with encoder, nil goes
+// back to the format string. Encoders are given the caller of each record
+func (handler *BasicHandler) SetEncoder(encoder Encoder) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	oldEncoder := handler.encoder
+	handler.encoder = encoder
+	err = handler.setFormatter()
+	if err != nil {
+		handler.encoder = oldEncoder
+		return
+	}
+	invalidateLevels()
+	return
+}
+
+// LogfmtEncoder writes records as logfmt lines:
+//
+//	time=2017-06-14T00:17:06.693+08:00 level=ERROR logger=db caller=db.go:42 msg="query failed" table=users
+//
+// followed by the fields of the record and the stack trace, if any
+type LogfmtEncoder struct {
+	TimeLayout string // layout of time, RFC 3339 with milliseconds when empty
+}
+
+const logfmtTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+func (encoder *LogfmtEncoder) Encode(buf []byte, r *Record) []byte {
+	layout := encoder.TimeLayout
+	if layout == "" {
+		layout = logfmtTimeLayout
+	}
+	buf = append(buf, "time="...)
+	buf = appendLogfmtValue(buf, r.Time.Format(layout))
+	buf = append(buf, " level="...)
+	buf = append(buf, r.Level.String()...)
+	buf = append(buf, " logger="...)
+	buf = appendLogfmtValue(buf, r.Name)
+	if r.PathName != "" {
+		buf = append(buf, " caller="...)
+		buf = appendLogfmtValue(buf, r.FileName()+":"+strconv.Itoa(r.LineNo))
+	}
+	buf = append(buf, " msg="...)
+	buf = appendLogfmtValue(buf, r.Message)
+	if len(r.Fields) > 0 {
+		buf = append(buf, ' ')
+		buf = appendFields(buf, r)
+	}
+	if r.Stack != "" {
+		buf = append(buf, " stack="...)
+		buf = appendLogfmtValue(buf, r.Stack)
+	}
+	return buf
+}
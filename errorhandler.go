@@ -0,0 +1,183 @@
+package logging
+
+import "fmt"
+import "io"
+import "os"
+import "sync"
+import "time"
+
+// ErrorHandler is called when a handler fails to write, open or rotate its
+// log file. It is called with the handler locked, so it must not log to the
+// handler that reported the error
+type ErrorHandler func(err error)
+
+var errorMutex = new(sync.Mutex)
+var defaultErrorHandler = NewRateLimitedErrorHandler(os.Stderr, time.Minute)
+
+// retryInterval is how long a broken handler waits before reopening its file
+var retryInterval = time.Second
+
+// NewRateLimitedErrorHandler returns an ErrorHandler printing to out at most
+// one error per interval, the number of suppressed errors is printed with the
+// next one
+func NewRateLimitedErrorHandler(out io.Writer, interval time.Duration) ErrorHandler {
+	mu := new(sync.Mutex)
+	last := time.Time{}
+	suppressed := 0
+	return func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		if !last.IsZero() && now.Sub(last) < interval {
+			suppressed++
+			return
+		}
+		last = now
+		if suppressed > 0 {
+			fmt.Fprintf(out, "logging: %s (%d more errors suppressed)\n", err, suppressed)
+		} else {
+			fmt.Fprintf(out, "logging: %s\n", err)
+		}
+		suppressed = 0
+	}
+}
+
+// SetErrorHandler replaces the ErrorHandler used by handlers which do not
+// have their own one
+func SetErrorHandler(errorHandler ErrorHandler) {
+	errorMutex.Lock()
+	defer errorMutex.Unlock()
+	defaultErrorHandler = errorHandler
+}
+
+func getErrorHandler() ErrorHandler {
+	errorMutex.Lock()
+	defer errorMutex.Unlock()
+	return defaultErrorHandler
+}
+
+func (handler *BasicHandler) SetErrorHandler(errorHandler ErrorHandler) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.errorHandler = errorHandler
+	return
+}
+
+// SetFallback sets where records go while the log file can not be written,
+// it is os.Stderr by default and nil discards them
+func (handler *BasicHandler) SetFallback(fallback io.Writer) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.fallback = fallback
+	return
+}
+
+// GetFailedWrites returns how many records could not be written to the log
+// file since the handler was created
+func (handler *BasicHandler) GetFailedWrites() int64 {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	return handler.failedWrites
+}
+
+func (handler *BasicHandler) reportError(err error) {
+	if err == nil {
+		return
+	}
+	errorHandler := handler.errorHandler
+	if errorHandler == nil {
+		errorHandler = getErrorHandler()
+	}
+	if errorHandler != nil {
+		errorHandler(err)
+	}
+}
+
+// write sends p to the log file, a broken handler tries to reopen its file
+// with reopen once per retryInterval and uses the fallback meanwhile
+func (handler *BasicHandler) write(logLevel LogLevel, p []byte, reopen func() error) (err error) {
+	if handler.closed {
+		handler.failedWrites++
+		err = ErrHandlerClosed
+		handler.reportError(err)
+		return
+	}
+	if handler.broken {
+		if time.Now().Before(handler.retryTime) {
+			handler.writeFallback(p)
+			return
+		}
+		err = reopen()
+		if err != nil {
+			handler.retryTime = time.Now().Add(retryInterval)
+			handler.reportError(err)
+			handler.writeFallback(p)
+			return
+		}
+		handler.broken = false
+		handler.brokenErr = nil
+		if handler.buffer != nil {
+			// records buffered before the handler broke go to the new file,
+			// those of a failed flush already went to the fallback
+			handler.buffer.Flush()
+			handler.buffer.Reset(handlerOut{handler})
+			handler.buffered = 0
+		}
+	}
+	fallback := true
+	if handler.buffer != nil {
+		err = handler.writeBuffered(p)
+		if err == nil && (handler.syncPolicy == SyncEachRecord || handler.flushOnError && logLevel >= ERROR) {
+			// on failure p went to the fallback with the buffered records
+			err = handler.buffer.Flush()
+			fallback = false
+		}
+	} else {
+		_, err = handler.out.Write(p)
+	}
+	if err == nil && handler.syncPolicy == SyncEachRecord {
+		err = handler.syncOut()
+	}
+	if err != nil {
+		handler.setBroken(err)
+		handler.reportError(err)
+		if fallback {
+			handler.writeFallback(p)
+		}
+	}
+	return
+}
+
+// writeBuffered adds p to the buffer. The buffer is flushed before when p
+// doesn't fit, so p is never part of a failed flush, and a p larger than
+// the buffer is written straight to the file
+func (handler *BasicHandler) writeBuffered(p []byte) (err error) {
+	if len(p) > handler.buffer.Available() {
+		err = handler.buffer.Flush()
+		if err != nil {
+			return
+		}
+	}
+	if len(p) > handler.buffer.Available() {
+		_, err = handler.out.Write(p)
+		return
+	}
+	handler.buffer.Write(p)
+	handler.buffered++
+	return
+}
+
+// setBroken sends the records to the fallback until the file is reopened,
+// err is returned by Flush and Sync meanwhile
+func (handler *BasicHandler) setBroken(err error) {
+	handler.broken = true
+	handler.brokenErr = err
+	handler.retryTime = time.Now()
+}
+
+func (handler *BasicHandler) writeFallback(p []byte) {
+	handler.failedWrites++
+	if handler.fallback != nil {
+		handler.fallback.Write(p)
+	}
+}
@@ -0,0 +1,143 @@
+package logging
+
+import "fmt"
+import "strconv"
+import "time"
+import "unicode/utf8"
+
+// Field is a key value pair attached to every record of a logger view
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// badKey names a value given without a string key
+const badKey = "!BADKEY"
+
+// With returns a view of the logger adding the fields built from
+// keysAndValues, alternating keys and values, to each of its records. The
+// view shares the handlers of the logger, a value without a string key is
+// kept under "!BADKEY"
+func (fl *FileLogger) With(keysAndValues ...interface{}) *FileLogger {
+	fields := make([]Field, len(fl.fields), len(fl.fields)+(len(keysAndValues)+1)/2)
+	copy(fields, fl.fields)
+	for i := 0; i < len(keysAndValues); i++ {
+		key, ok := keysAndValues[i].(string)
+		if !ok || i+1 == len(keysAndValues) {
+			fields = append(fields, Field{Key: badKey, Value: keysAndValues[i]})
+			continue
+		}
+		fields = append(fields, Field{Key: key, Value: keysAndValues[i+1]})
+		i++
+	}
+	return &FileLogger{name: fl.name, base: fl.root(), callerSkip: fl.callerSkip, fields: fields}
+}
+
+// appendFieldValue appends the text of a field value
+func appendFieldValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, "<nil>"...)
+	case string:
+		return append(buf, v...)
+	case []byte:
+		return append(buf, v...)
+	case bool:
+		return strconv.AppendBool(buf, v)
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(buf, v, 10)
+	case int32:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case uint:
+		return strconv.AppendUint(buf, uint64(v), 10)
+	case uint64:
+		return strconv.AppendUint(buf, v, 10)
+	case uint32:
+		return strconv.AppendUint(buf, uint64(v), 10)
+	case float64:
+		return strconv.AppendFloat(buf, v, 'g', -1, 64)
+	case float32:
+		return strconv.AppendFloat(buf, float64(v), 'g', -1, 32)
+	case time.Time:
+		return v.AppendFormat(buf, time.RFC3339Nano)
+	case time.Duration:
+		return append(buf, v.String()...)
+	case error:
+		return append(buf, v.Error()...)
+	case fmt.Stringer:
+		return append(buf, v.String()...)
+	default:
+		return append(buf, fmt.Sprint(v)...)
+	}
+}
+
+// appendLogfmtKey appends key with the characters logfmt can't hold in a
+// key replaced by "_"
+func appendLogfmtKey(buf []byte, key string) []byte {
+	if key == "" {
+		return append(buf, '_')
+	}
+	for _, c := range key {
+		if c <= ' ' || c == '=' || c == '"' || c == utf8.RuneError || c == 0x7f {
+			c = '_'
+		}
+		buf = append(buf, string(c)...)
+	}
+	return buf
+}
+
+// appendLogfmtValue appends value, quoted and escaped when it is empty or
+// holds spaces, "=", quotes, backslashes, control characters or invalid
+// UTF-8. strconv.Quote escapes backslashes too, so a value ending in a
+// backslash can't escape the closing quote
+func appendLogfmtValue(buf []byte, value string) []byte {
+	if !needsQuoting(value) {
+		return append(buf, value...)
+	}
+	return strconv.AppendQuote(buf, value)
+}
+
+func needsQuoting(value string) bool {
+	if value == "" {
+		return true
+	}
+	for i := 0; i < len(value); {
+		c := value[i]
+		if c < utf8.RuneSelf {
+			if c <= ' ' || c == '=' || c == '"' || c == '\\' || c == 0x7f {
+				return true
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(value[i:])
+		if r == utf8.RuneError || !strconv.IsPrint(r) {
+			return true
+		}
+		i += size
+	}
+	return false
+}
+
+// appendLogfmtPair appends key=value
+func appendLogfmtPair(buf []byte, key string, value string) []byte {
+	buf = appendLogfmtKey(buf, key)
+	buf = append(buf, '=')
+	return appendLogfmtValue(buf, value)
+}
+
+// appendFields appends the fields of r as logfmt pairs separated by spaces,
+// %(fields) in a format string
+func appendFields(buf []byte, r *Record) []byte {
+	var value []byte
+	for i, field := range r.Fields {
+		if i > 0 {
+			buf = append(buf, ' ')
+		}
+		value = appendFieldValue(value[:0], field.Value)
+		buf = appendLogfmtPair(buf, field.Key, string(value))
+	}
+	return buf
+}
@@ -1,247 +1,502 @@
 package logging
 
+import "bytes"
+import "errors"
 import "fmt"
-import "runtime"
+import "os"
 import "path"
 import "path/filepath"
+import "runtime"
 import "strconv"
+import "strings"
+import "sync"
+import "sync/atomic"
 import "time"
-import "errors"
 
-type formatter struct {
-	name       string // Name of the logger
-	levelName  string
-	pathName   string
-	fileName   string
-	funcName   string
-	lineNo     string
-	date       string
-	unixTime   string
-	dateTime   string
-	weekday    string
-	nanoSecond string
-	ascTime    string
-	message    string
-}
-
-func baseFormatter() (fm formatter) {
-	fm = formatter{
-		name:       "!@#",
-		levelName:  "!@#",
-		pathName:   "!@#",
-		fileName:   "!@#",
-		funcName:   "!@#",
-		lineNo:     "!@#",
-		date:       "!@#",
-		unixTime:   "!@#",
-		dateTime:   "!@#",
-		weekday:    "!@#",
-		nanoSecond: "!@#",
-		ascTime:    "!@#",
-		message:    "!@#",
-	}
-	return
+// Record holds everything a handler needs to format one log call
+type Record struct {
+	Name     string // Name of the logger
+	Level    LogLevel
+	Time     time.Time
+	Message  string
+	PathName string // empty when the caller is unknown
+	FuncName string
+	LineNo   int
+	PC       uintptr // program counter of the caller, 0 when unknown
+	Err      error   // the error given to ErrorErr
+	Stack    string  // stack trace of the call and of Err, empty if not taken
+	Fields   []Field
 }
 
-func (fm *formatter) getTimeInfo() {
-	t := time.Now()
-	fm.ascTime = t.Format("2006-01-02 15:04:05,") + fmt.Sprintf("%09s", strconv.Itoa(t.Nanosecond()))
-	fm.date = fm.ascTime[:10]
-	fm.dateTime = fm.ascTime[:19]
-	fm.nanoSecond = fm.ascTime[20:]
-	fm.unixTime = strconv.FormatInt(t.Unix(), 10)
-	fm.weekday = t.Weekday().String()
+func (r *Record) FileName() string {
+	return filepath.Base(r.PathName)
 }
 
-func (fm *formatter) getDate() string {
-	if fm.date == "!@#" {
-		fm.getTimeInfo()
+// setCaller records the caller skip frames above the function calling it,
+// functions marked with Helper are skipped as well
+func (r *Record) setCaller(skip int) {
+	var pcs [16]uintptr
+	n := runtime.Callers(skip+2, pcs[:])
+	r.PathName = ""
+	r.LineNo = 0
+	r.FuncName = ""
+	r.PC = 0
+	if n == 0 {
+		return
+	}
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		r.PathName = frame.File
+		r.LineNo = frame.Line
+		r.FuncName = path.Base(frame.Function)
+		r.PC = frame.PC + 1 // a return address, as runtime.Callers gives
+		if !more || !isHelper(frame.Function) {
+			break
+		}
 	}
-	return fm.date
 }
 
-func (fm *formatter) getDateTime() string {
-	if fm.dateTime == "!@#" {
-		fm.getTimeInfo()
+var helperMutex = new(sync.RWMutex)
+var helperFuncs = map[string]bool{}
+var hasHelpers int32
+
+// Helper marks the calling function as a logging helper, records logged from
+// it report the caller of the helper instead, like testing.T.Helper
+func Helper() {
+	var pcs [1]uintptr
+	if runtime.Callers(2, pcs[:]) == 0 {
+		return
 	}
-	return fm.dateTime
+	frame, _ := runtime.CallersFrames(pcs[:]).Next()
+	if isHelper(frame.Function) {
+		return
+	}
+	helperMutex.Lock()
+	defer helperMutex.Unlock()
+	helperFuncs[frame.Function] = true
+	atomic.StoreInt32(&hasHelpers, 1)
 }
 
-func (fm *formatter) getNanoSecond() string {
-	if fm.nanoSecond == "!@#" {
-		fm.getTimeInfo()
+func isHelper(function string) bool {
+	if atomic.LoadInt32(&hasHelpers) == 0 {
+		return false
 	}
-	return fm.nanoSecond
+	helperMutex.RLock()
+	defer helperMutex.RUnlock()
+	return helperFuncs[function]
 }
 
-func (fm *formatter) getAscTime() string {
-	if fm.ascTime == "!@#" {
-		fm.getTimeInfo()
-	}
-	return fm.ascTime
+// formatToken appends the value of one %(name) token to buf
+type formatToken func(buf []byte, r *Record) []byte
+
+// segment is either a literal part of the format string or a token
+type segment struct {
+	literal string
+	token   formatToken
 }
 
-func (fm *formatter) getUnixTime() string {
-	if fm.unixTime == "!@#" {
-		fm.getTimeInfo()
-	}
-	return fm.unixTime
+var callerTokens = map[string]bool{
+	"pathName": true,
+	"fileName": true,
+	"funcName": true,
+	"lineNo":   true,
 }
 
-func (fm *formatter) getWeekday() string {
-	if fm.weekday == "!@#" {
-		fm.getTimeInfo()
-	}
-	return fm.weekday
+var formatTokens = map[string]formatToken{
+	"name": func(buf []byte, r *Record) []byte {
+		return append(buf, r.Name...)
+	},
+	"levelName": func(buf []byte, r *Record) []byte {
+		return append(buf, r.Level.String()...)
+	},
+	"pathName": func(buf []byte, r *Record) []byte {
+		if r.PathName == "" {
+			return append(buf, "???"...)
+		}
+		return append(buf, r.PathName...)
+	},
+	"fileName": func(buf []byte, r *Record) []byte {
+		if r.PathName == "" {
+			return append(buf, "???"...)
+		}
+		return append(buf, r.FileName()...)
+	},
+	"funcName": func(buf []byte, r *Record) []byte {
+		if r.FuncName == "" {
+			return append(buf, "???"...)
+		}
+		return append(buf, r.FuncName...)
+	},
+	"lineNo": func(buf []byte, r *Record) []byte {
+		if r.PathName == "" {
+			return append(buf, "???"...)
+		}
+		return strconv.AppendInt(buf, int64(r.LineNo), 10)
+	},
+	"date": func(buf []byte, r *Record) []byte {
+		return r.Time.AppendFormat(buf, "2006-01-02")
+	},
+	"unixTime": func(buf []byte, r *Record) []byte {
+		return strconv.AppendInt(buf, r.Time.Unix(), 10)
+	},
+	"dateTime": func(buf []byte, r *Record) []byte {
+		return r.Time.AppendFormat(buf, "2006-01-02 15:04:05")
+	},
+	"weekday": func(buf []byte, r *Record) []byte {
+		return append(buf, r.Time.Weekday().String()...)
+	},
+	"nanoSecond": func(buf []byte, r *Record) []byte {
+		return appendInt(buf, r.Time.Nanosecond(), 9)
+	},
+	"ascTime": func(buf []byte, r *Record) []byte {
+		buf = r.Time.AppendFormat(buf, "2006-01-02 15:04:05,")
+		return appendInt(buf, r.Time.Nanosecond(), 9)
+	},
+	"message": func(buf []byte, r *Record) []byte {
+		return append(buf, r.Message...)
+	},
+	"fields": appendFields,
+	"process": func(buf []byte, r *Record) []byte {
+		return strconv.AppendInt(buf, int64(processId), 10)
+	},
+	"processName": func(buf []byte, r *Record) []byte {
+		return append(buf, processName...)
+	},
+	"goroutine": func(buf []byte, r *Record) []byte {
+		return appendGoroutineId(buf)
+	},
+	"hostname": func(buf []byte, r *Record) []byte {
+		return append(buf, hostname...)
+	},
+	"relativeCreated": func(buf []byte, r *Record) []byte {
+		return strconv.AppendInt(buf, int64(r.Time.Sub(startTime)/time.Millisecond), 10)
+	},
+	"msecs": func(buf []byte, r *Record) []byte {
+		return appendInt(buf, r.Time.Nanosecond()/int(time.Millisecond), 3)
+	},
+	"microSecond": func(buf []byte, r *Record) []byte {
+		return appendInt(buf, r.Time.Nanosecond()/int(time.Microsecond), 6)
+	},
+	"isoTime": func(buf []byte, r *Record) []byte {
+		return r.Time.AppendFormat(buf, "2006-01-02T15:04:05.000Z07:00")
+	},
+	"utcTime": func(buf []byte, r *Record) []byte {
+		return r.Time.UTC().AppendFormat(buf, "2006-01-02T15:04:05.000Z")
+	},
+	"stack": func(buf []byte, r *Record) []byte {
+		if r.Stack == "" {
+			return buf
+		}
+		buf = append(buf, '\n')
+		return append(buf, r.Stack...)
+	},
 }
 
-func (fm *formatter) getPathName() string {
-	if fm.pathName == "!@#" {
-		fm.getCallInfo()
+var processId = os.Getpid()
+var processName = filepath.Base(os.Args[0])
+var hostname, _ = os.Hostname()
+var startTime = time.Now()
+
+// appendGoroutineId appends the id of the running goroutine, taken from the
+// "goroutine 18 [running]:" header of its stack
+func appendGoroutineId(buf []byte) []byte {
+	var stack [64]byte
+	n := runtime.Stack(stack[:], false)
+	id := bytes.TrimPrefix(stack[:n], []byte("goroutine "))
+	if i := bytes.IndexByte(id, ' '); i > 0 {
+		return append(buf, id[:i]...)
+	}
+	return append(buf, "???"...)
+}
 
+// appendInt appends n padded with zeros to width digits
+func appendInt(buf []byte, n int, width int) []byte {
+	var digits [20]byte
+	i := len(digits)
+	for n >= 10 || width > 1 {
+		i--
+		width--
+		digits[i] = byte('0' + n%10)
+		n /= 10
 	}
-	return fm.pathName
+	i--
+	digits[i] = byte('0' + n)
+	return append(buf, digits[i:]...)
+}
+
+// paramTokens build the tokens written as %(name:param) at compile time
+var paramTokens = map[string]func(param string) (formatToken, error){
+	"time": func(layout string) (formatToken, error) {
+		return func(buf []byte, r *Record) []byte {
+			return r.Time.AppendFormat(buf, layout)
+		}, nil
+	},
+	"env": func(param string) (formatToken, error) {
+		value := os.Getenv(param)
+		return func(buf []byte, r *Record) []byte {
+			return append(buf, value...)
+		}, nil
+	},
 }
 
-func (fm *formatter) getFileName() string {
-	if fm.fileName == "!@#" {
-		fm.getCallInfo()
+// defaultTimeLayout is the layout of %(time) unless the handler sets one
+const defaultTimeLayout = "2006-01-02 15:04:05.000"
 
+// formatOptions are the handler settings a format string is compiled with
+type formatOptions struct {
+	timeLayout string   // layout of %(time)
+	palette    *Palette // nil when the handler writes no colors
+	multiline  MultilinePolicy
+}
+
+// lookupToken finds the token called name, %(time) without a layout uses
+// the layout of the options
+func lookupToken(name string, options formatOptions) (token formatToken, err error) {
+	tokenMutex.RLock()
+	token, ok := formatTokens[name]
+	if !ok {
+		token, ok = customTokens[name]
+	}
+	tokenMutex.RUnlock()
+	if ok {
+		return token, nil
+	}
+	if name == "time" || name == "time:" {
+		return paramTokens["time"](options.timeLayout)
+	}
+	if colorTokens[name] {
+		return colorToken(name, options.palette), nil
+	}
+	if i := strings.IndexByte(name, ':'); i > 0 {
+		if newToken, ok := paramTokens[name[:i]]; ok {
+			return newToken(name[i+1:])
+		}
 	}
-	return fm.fileName
+	return nil, errors.New("error formatName %(" + name + "), it is neither a built-in token nor registered with RegisterFormatToken")
 }
 
-func (fm *formatter) getFuncName() string {
-	if fm.funcName == "!@#" {
-		fm.getCallInfo()
+var tokenMutex = new(sync.RWMutex)
+var customTokens = map[string]formatToken{}
 
+// RegisterFormatToken adds the token %(name) for every handler, its value is
+// returned by fn for each record. Handlers look tokens up when their format
+// string is set, so register tokens before calling SetFormatString or
+// MapConfig. A registered token can be replaced but a built-in one can't
+func RegisterFormatToken(name string, fn func(*Record) string) (err error) {
+	if name == "" || strings.ContainsAny(name, "%():|") {
+		err = errors.New("error token name \"" + name + "\"")
+		return
 	}
-	return fm.funcName
+	if fn == nil {
+		err = errors.New("token function can't be nil")
+		return
+	}
+	tokenMutex.Lock()
+	defer tokenMutex.Unlock()
+	_, builtin := formatTokens[name]
+	_, param := paramTokens[name]
+	if builtin || param || colorTokens[name] {
+		err = errors.New("%(" + name + ") is a built-in token")
+		return
+	}
+	customTokens[name] = func(buf []byte, r *Record) []byte {
+		return append(buf, fn(r)...)
+	}
+	return
+}
+
+// unregisterFormatToken removes a token added by RegisterFormatToken, format
+// strings already compiled keep it
+func unregisterFormatToken(name string) {
+	tokenMutex.Lock()
+	defer tokenMutex.Unlock()
+	delete(customTokens, name)
 }
 
-func (fm *formatter) getLevelName() string {
-	return fm.levelName
+// compileFormat splits a format string into literal and token segments,
+// "%%" stands for a literal "%". With a palette the level name, the time
+// and the logger name are colored unless the format places %(color) itself
+func compileFormat(formatString string, options formatOptions) (segments []segment, needCaller bool, err error) {
+	literal := []byte{}
+	autoColor := options.palette != nil && !strings.Contains(formatString, "%(color")
+	for i := 0; i < len(formatString); i++ {
+		if formatString[i] == '%' && i+1 < len(formatString) {
+			switch formatString[i+1] {
+			case '%':
+				literal = append(literal, '%')
+				i++
+				continue
+			case '(':
+				end := strings.IndexByte(formatString[i+2:], ')')
+				if end < 0 {
+					err = errors.New("error format \"" + formatString + "\"")
+					return
+				}
+				field := strings.Split(formatString[i+2:i+2+end], "|")
+				name := field[0]
+				token, err1 := lookupToken(name, options)
+				if err1 != nil {
+					err = err1
+					return
+				}
+				if !colorTokens[name] {
+					token = sanitizeToken(name, token, options.multiline)
+				}
+				spec, n := parseTokenSpec(formatString[i+3+end:])
+				spec.modifiers = field[1:]
+				token, err1 = spec.wrap(token)
+				if err1 != nil {
+					err = errors.New("error format %(" + formatString[i+2:i+2+end] + "): " + err1.Error())
+					return
+				}
+				if autoColor {
+					token = colorize(name, token, options.palette)
+				}
+				if len(literal) > 0 {
+					segments = append(segments, segment{literal: string(literal)})
+					literal = literal[:0]
+				}
+				segments = append(segments, segment{token: token})
+				needCaller = needCaller || callerTokens[name]
+				i += 2 + end + n
+				continue
+			}
+		}
+		literal = append(literal, formatString[i])
+	}
+	literal = append(literal, '\n')
+	segments = append(segments, segment{literal: string(literal)})
+	return
 }
 
-func (fm *formatter) setLevelName(logLevel LogLevel) {
-	switch logLevel {
-	case DEBUG:
-		fm.levelName = "DEBUG"
-	case WARNING:
-		fm.levelName = "WARNING"
-	case ERROR:
-		fm.levelName = "ERROR"
-	default:
-		fm.levelName = "ERROR"
+func (handler *BasicHandler) setFormatter() (err error) {
+	options := formatOptions{timeLayout: handler.timeLayout, multiline: handler.multiline}
+	if options.timeLayout == "" {
+		options.timeLayout = defaultTimeLayout
 	}
+	if handler.useColor() {
+		options.palette = handler.palette
+		if options.palette == nil {
+			palette := DefaultPalette
+			options.palette = &palette
+		}
+	}
+	segments, needCaller, err := compileFormat(handler.logConfig.formatString, options)
+	if err != nil {
+		return
+	}
+	handler.segments = segments
+	handler.needCaller = needCaller || handler.encoder != nil
+	return
 }
 
-func (fm *formatter) getName() string {
-	return fm.name
+// formatMessage is fmt.Sprintf, skipped for a message without arguments or
+// verbs which Sprintf would return unchanged
+func formatMessage(format string, v ...interface{}) string {
+	if len(v) == 0 && strings.IndexByte(format, '%') < 0 {
+		return format
+	}
+	return fmt.Sprintf(format, v...)
 }
 
-func (fm *formatter) setName(name string) {
-	fm.name = name
+// formatRecord formats r for this handler, the shared record is adjusted
+// by adjustRecord while formatting and restored afterwards
+func (handler *BasicHandler) formatRecord(buf []byte, r *Record) []byte {
+	saved := handler.adjustRecord(r)
+	buf = handler.format(buf, r)
+	*r = saved
+	return buf
 }
 
-func (fm *formatter) getCallInfo() {
-	pc, file, line, ok := runtime.Caller(5)
-	if ok {
-		fm.pathName = file
-		fm.fileName = filepath.Base(file)
-		fm.lineNo = strconv.Itoa(line)
-		fm.funcName = path.Base(runtime.FuncForPC(pc).Name())
-	} else {
-		fm.pathName = "???"
-		fm.fileName = "???"
-		fm.lineNo = "???"
-		fm.funcName = "???"
-	}
-}
-
-func (fm *formatter) getLineNo() string {
-	if fm.lineNo == "!@#" {
-		fm.getCallInfo()
-	}
-	return fm.lineNo
-}
-
-func (fm *formatter) getMessage() string {
-	return fm.message
-}
-
-func (fm *formatter) setMessage(message string) {
-	fm.message = message
-}
-
-func (fm *formatter) getNil() string {
-	return "error format had been setted"
-}
-
-func (handler *BasicHandler) setFormatFunc(format string) (err error) {
-	switch format {
-	case "name":
-		handler.formatFunc = append(handler.formatFunc, handler.getName)
-	case "levelName":
-		handler.formatFunc = append(handler.formatFunc, handler.getLevelName)
-	case "pathName":
-		handler.formatFunc = append(handler.formatFunc, handler.getPathName)
-	case "fileName":
-		handler.formatFunc = append(handler.formatFunc, handler.getFileName)
-	case "funcName":
-		handler.formatFunc = append(handler.formatFunc, handler.getFuncName)
-	case "lineNo":
-		handler.formatFunc = append(handler.formatFunc, handler.getLineNo)
-	case "date":
-		handler.formatFunc = append(handler.formatFunc, handler.getDate)
-	case "unixTime":
-		handler.formatFunc = append(handler.formatFunc, handler.getUnixTime)
-	case "nanoSecond":
-		handler.formatFunc = append(handler.formatFunc, handler.getNanoSecond)
-	case "ascTime":
-		handler.formatFunc = append(handler.formatFunc, handler.getAscTime)
-	case "dateTime":
-		handler.formatFunc = append(handler.formatFunc, handler.getDateTime)
-	case "weekday":
-		handler.formatFunc = append(handler.formatFunc, handler.getWeekday)
-	case "message":
-		handler.formatFunc = append(handler.formatFunc, handler.getMessage)
-	default:
-		err = errors.New("error formatName %(" + format + ")")
+// adjustRecord prepares the shared record r for this handler and returns
+// it as it was, for the caller to restore: the time is moved to the time
+// zone of the handler, a stack trace taken for another handler with a
+// lower stack level is hidden and secrets are masked
+func (handler *BasicHandler) adjustRecord(r *Record) (saved Record) {
+	saved = *r
+	if handler.location != nil {
+		r.Time = r.Time.In(handler.location)
+	}
+	if r.Err == nil && r.Level < handler.stackLevel {
+		r.Stack = ""
+	}
+	if handler.redactor != nil {
+		handler.redactRecord(r)
 	}
 	return
 }
 
-func (handler *BasicHandler) setFormatter() (err error) {
-	formatString := handler.logConfig.formatString
-	begin := false
-	format := []byte{}
-	for i := 0; i < len(formatString); i++ {
-		if begin {
-			if formatString[i] == ')' {
-				begin = false
-				err = handler.setFormatFunc(string(format[1:]))
-				if err != nil {
-					return
-				}
-			} else {
-				format = append(format, formatString[i])
-			}
-		} else if formatString[i] == '%' {
-			if i+1 < len(formatString) && formatString[i+1] == '(' {
-				begin = true
-				format = format[:0]
-				handler.formatString += "%s"
-			}
-
+func (handler *BasicHandler) format(buf []byte, r *Record) []byte {
+	if handler.encoder != nil {
+		buf = handler.encoder.Encode(buf, r)
+		return append(buf, '\n')
+	}
+	start := len(buf)
+	for _, seg := range handler.segments {
+		if seg.token == nil {
+			buf = append(buf, seg.literal...)
 		} else {
-			handler.formatString += string(formatString[i])
+			buf = seg.token(buf, r)
 		}
 	}
-	handler.formatString += "\n"
-	if begin {
-		handler.formatString = ""
-		err = errors.New("error format \"" + handler.logConfig.formatString + "\"")
+	if handler.multiline == MultilineEncode {
+		line := getBuffer()
+		*line = append(*line, buf[start:len(buf)-1]...)
+		buf = append(buf[:start], `{"record":`...)
+		buf = appendJSONString(buf, string(*line))
+		if r.Stack != "" {
+			buf = appendJSONPair(buf, "stack", r.Stack)
+		}
+		buf = append(buf, "}\n"...)
+		putBuffer(line)
+	}
+	return buf
+}
+
+// SetTimeLayout sets the layout of %(time), a token with its own layout
+// such as %(time:2006-01-02T15:04:05.000Z07:00) is not affected
+func (handler *BasicHandler) SetTimeLayout(layout string) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if layout == "" {
+		err = errors.New("layout can't be empty")
+		return
+	}
+	oldLayout := handler.timeLayout
+	handler.timeLayout = layout
+	err = handler.setFormatter()
+	if err != nil {
+		handler.timeLayout = oldLayout
 	}
 	return
 }
+
+// SetTimeLocation sets the time zone of every time token, such as time.UTC
+// or time.Local. nil keeps the time zone of the record, the local one
+func (handler *BasicHandler) SetTimeLocation(location *time.Location) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.location = location
+	return
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 256)
+		return &buf
+	},
+}
+
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(buf *[]byte) {
+	// keep huge records from pinning memory in the pool
+	if cap(*buf) > 64*1024 {
+		return
+	}
+	*buf = (*buf)[:0]
+	bufferPool.Put(buf)
+}
@@ -0,0 +1,225 @@
+package logging
+
+import "bytes"
+import "compress/gzip"
+import "compress/zlib"
+import "crypto/rand"
+import "errors"
+import "io"
+import "net"
+import "os"
+import "strconv"
+import "sync"
+
+type GELFCompression int
+
+const (
+	GELFCompressNone GELFCompression = iota
+	GELFCompressGzip
+	GELFCompressZlib
+)
+
+const (
+	// DefaultGELFChunkSize keeps datagrams below the usual internet MTU
+	DefaultGELFChunkSize = 1420
+	gelfChunkHeaderSize  = 12
+	gelfMaxChunks        = 128
+)
+
+// GELFHandler sends records as GELF 1.1 messages to Graylog over UDP,
+// messages larger than the chunk size are split into GELF chunks
+type GELFHandler struct {
+	BasicHandler
+	address     string
+	chunkSize   int
+	compression GELFCompression
+}
+
+func GetGELFHandler(address string) (gelfHandler *GELFHandler, err error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	gelfHandler = new(GELFHandler)
+	logConfig := GetBasicConfig()
+	gelfHandler.address = address
+	gelfHandler.chunkSize = DefaultGELFChunkSize
+	gelfHandler.logConfig = &logConfig
+	gelfHandler.mu = new(sync.Mutex)
+	gelfHandler.id = handlerId
+	handlerId++
+	gelfHandler.fallback = os.Stderr
+	gelfHandler.stackLevel = noLevel
+	gelfHandler.uid, gelfHandler.gid = -1, -1
+	gelfHandler.encoder = &GELFEncoder{}
+	err = gelfHandler.setOut()
+	if err != nil {
+		return
+	}
+	gelfHandler.setFormatter()
+	return
+}
+
+func (handler *GELFHandler) setOut() (err error) {
+	handler.closeOut()
+	conn, err := net.Dial("udp", handler.address)
+	if err != nil {
+		return
+	}
+	handler.out = &gelfWriter{conn: conn, chunkSize: handler.chunkSize, compression: handler.compression, drop: handler.dropMessage}
+	return
+}
+
+// dropMessage sends a message too large for GELF to the fallback, the
+// handler keeps sending the next ones
+func (handler *GELFHandler) dropMessage(message []byte, err error) {
+	handler.reportError(err)
+	handler.writeFallback(append(message[:len(message):len(message)], '\n'))
+}
+
+// SetChunkSize sets the largest datagram sent, Graylog accepts up to 8192
+// bytes on a local network
+func (handler *GELFHandler) SetChunkSize(size int) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if size <= gelfChunkHeaderSize || size > 65507 {
+		err = errors.New("chunk size must be between " + strconv.Itoa(gelfChunkHeaderSize+1) + " and 65507")
+		return
+	}
+	handler.chunkSize = size
+	if out, ok := handler.out.(*gelfWriter); ok {
+		out.chunkSize = size
+	}
+	return
+}
+
+// SetCompression compresses each message with gzip or zlib before it is
+// chunked
+func (handler *GELFHandler) SetCompression(compression GELFCompression) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if compression < GELFCompressNone || compression > GELFCompressZlib {
+		err = errors.New("error GELF compression")
+		return
+	}
+	handler.compression = compression
+	if out, ok := handler.out.(*gelfWriter); ok {
+		out.compression = compression
+	}
+	return
+}
+
+func (handler *GELFHandler) writeLog(r *Record) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = handler.formatRecord(*buf, r)
+	err = handler.write(r.Level, *buf, handler.setOut)
+	return
+}
+
+// gelfWriter sends each line written to it as one GELF message, lines may
+// arrive in pieces when the handler buffers its output
+type gelfWriter struct {
+	conn        net.Conn
+	chunkSize   int
+	compression GELFCompression
+	pending     []byte
+	compressed  bytes.Buffer
+	drop        func(message []byte, err error) // called for a message needing too many chunks
+}
+
+// gelfSizeError is returned for a message of that many bytes needing more
+// than gelfMaxChunks chunks
+type gelfSizeError int
+
+func (size gelfSizeError) Error() string {
+	return "GELF message of " + strconv.Itoa(int(size)) + " bytes needs more than 128 chunks, dropped"
+}
+
+func (w *gelfWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.pending = append(w.pending, p...)
+			n += len(p)
+			return
+		}
+		message := p[:i]
+		if len(w.pending) > 0 {
+			w.pending = append(w.pending, message...)
+			message = w.pending
+		}
+		err1 := w.send(message)
+		if _, ok := err1.(gelfSizeError); ok && w.drop != nil {
+			w.drop(message, err1)
+			err1 = nil
+		}
+		w.pending = w.pending[:0]
+		if err1 != nil && err == nil {
+			err = err1
+		}
+		n += i + 1
+		p = p[i+1:]
+	}
+	return
+}
+
+func (w *gelfWriter) Read(p []byte) (n int, err error) {
+	return 0, io.EOF
+}
+
+func (w *gelfWriter) Close() error {
+	return w.conn.Close()
+}
+
+func (w *gelfWriter) send(message []byte) (err error) {
+	if w.compression != GELFCompressNone {
+		w.compressed.Reset()
+		var zw io.WriteCloser
+		if w.compression == GELFCompressGzip {
+			zw = gzip.NewWriter(&w.compressed)
+		} else {
+			zw = zlib.NewWriter(&w.compressed)
+		}
+		zw.Write(message)
+		err = zw.Close()
+		if err != nil {
+			return
+		}
+		message = w.compressed.Bytes()
+	}
+	if len(message) <= w.chunkSize {
+		_, err = w.conn.Write(message)
+		return
+	}
+	return w.sendChunks(message)
+}
+
+// sendChunks splits message into chunks sharing a random message id
+func (w *gelfWriter) sendChunks(message []byte) (err error) {
+	size := w.chunkSize - gelfChunkHeaderSize
+	count := (len(message) + size - 1) / size
+	if count > gelfMaxChunks {
+		err = gelfSizeError(len(message))
+		return
+	}
+	chunk := make([]byte, gelfChunkHeaderSize, w.chunkSize)
+	chunk[0], chunk[1] = 0x1e, 0x0f
+	_, err = rand.Read(chunk[2:10])
+	if err != nil {
+		return
+	}
+	chunk[11] = byte(count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(message) {
+			end = len(message)
+		}
+		chunk[10] = byte(i)
+		_, err = w.conn.Write(append(chunk[:gelfChunkHeaderSize], message[i*size:end]...))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
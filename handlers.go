@@ -1,37 +1,91 @@
 package logging
 
-import "fmt"
+import "bufio"
 import "sync"
 import "os"
 import "path"
 import "io"
 import "errors"
 import "strconv"
-import "syscall"
 import "time"
 import "path/filepath"
 import "sort"
 import "regexp"
-import "reflect"
+import "strings"
+import "io/ioutil"
 
 type LogHandler interface {
-	writeLog(name string, logLevel LogLevel, format string, v ...interface{})
+	writeLog(r *Record) error
 	getLogLevel() LogLevel
+	getStackLevel() LogLevel
+	needsCaller() bool
 	getId() int
-    Close()
+	retain()
+	release()
+	detach()
+	Flush() error
+	Sync() error
+	Close()
 }
 
+// ErrHandlerClosed is returned by writes and other operations on a handler
+// after it has been closed
+var ErrHandlerClosed = errors.New("logging: handler is closed")
+
 type BasicHandler struct {
-	mu        *sync.Mutex
-	logConfig *LogConfig
-	out       io.ReadWriteCloser
-	id        int
-	formatter
-	formatString string
-	formatFunc   []func() string
+	mu            *sync.Mutex
+	logConfig     *LogConfig
+	out           io.ReadWriteCloser
+	id            int
+	segments      []segment
+	needCaller    bool
+	errorHandler  ErrorHandler
+	fallback      io.Writer
+	failedWrites  int64
+	broken        bool
+	brokenErr     error
+	buffered      int
+	closed        bool
+	retryTime     time.Time
+	minFreeSpace  int64
+	diskLevel     LogLevel
+	diskCheckTime time.Time
+	buffer        *bufio.Writer
+	flushInterval time.Duration
+	flushTimer    *time.Timer
+	flushOnError  bool
+	syncPolicy    SyncPolicy
+	owners        int
+	released      bool
+	stackLevel    LogLevel
+	timeLayout    string
+	location      *time.Location
+	colorMode     ColorMode
+	palette       *Palette
+	encoder       Encoder
+	multiline     MultilinePolicy
+	redactor      *Redactor
+	fileMode      os.FileMode
+	dirMode       os.FileMode
+	uid           int
+	gid           int
+	createdDirs   []string
+	chain         *hashChain
+	archive       *archiveEncrypter
+	archiveDone   chan struct{} // closed when the backup being encrypted is done
 }
 
 func GetBasicHandler(fileDir, fileName string) (basicHandler *BasicHandler, err error) {
+	return GetBasicHandlerWithPermissions(fileDir, fileName, DefaultPermissions())
+}
+
+// GetBasicHandlerWithPermissions creates the log file and its directories
+// with perm, no other user can open them meanwhile
+func GetBasicHandlerWithPermissions(fileDir, fileName string, perm Permissions) (basicHandler *BasicHandler, err error) {
+	err = perm.check()
+	if err != nil {
+		return
+	}
 	mutex.Lock()
 	defer mutex.Unlock()
 	basicHandler = new(BasicHandler)
@@ -43,19 +97,19 @@ func GetBasicHandler(fileDir, fileName string) (basicHandler *BasicHandler, err
 	basicHandler.id = handlerId
 	handlerId++
 	basicHandler.out = os.Stdout
+	basicHandler.fallback = os.Stderr
+	basicHandler.stackLevel = noLevel
+	basicHandler.setPermissions(perm)
 	err = basicHandler.setOut()
 	if err != nil {
 		return
 	}
-	basicHandler.formatter = baseFormatter()
 	basicHandler.setFormatter()
 	return
 }
 
 func (handler *BasicHandler) setOut() (err error) {
-	if handler.out != os.Stdout {
-		handler.out.Close()
-	}
+	handler.closeOut()
 	if handler.logConfig.fileDir == "" {
 		handler.logConfig.fileDir = "."
 	}
@@ -67,7 +121,7 @@ func (handler *BasicHandler) setOut() (err error) {
 			return
 		}
 		filepath := path.Join(handler.logConfig.fileDir, handler.logConfig.fileName)
-		handler.out, err = os.OpenFile(filepath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+		handler.out, err = handler.openFile(filepath)
 	}
 	return
 }
@@ -75,11 +129,14 @@ func (handler *BasicHandler) setOut() (err error) {
 func (handler *BasicHandler) SetFormatString(format string) (err error) {
 	handler.mu.Lock()
 	defer handler.mu.Unlock()
-	handler.formatter = baseFormatter()
+	oldFormat := handler.logConfig.formatString
 	handler.logConfig.formatString = format
-	handler.formatString = ""
-	handler.formatFunc = []func() string{}
 	err = handler.setFormatter()
+	if err != nil {
+		handler.logConfig.formatString = oldFormat
+		return
+	}
+	invalidateLevels()
 	return
 }
 
@@ -95,6 +152,11 @@ func (handler *BasicHandler) SetFilePath(fileDir, fileName string) (err error) {
 	handler.logConfig.fileDir = fileDir
 	handler.logConfig.fileName = fileName
 	err = handler.setOut()
+	if err != nil {
+		return
+	}
+	// colors depend on whether the new output is a terminal
+	err = handler.setFormatter()
 	return
 }
 
@@ -108,20 +170,83 @@ func (handler *BasicHandler) SetLogLevel(logLevel LogLevel) (err error) {
 	handler.mu.Lock()
 	defer handler.mu.Unlock()
 	handler.logConfig.logLevel = logLevel
+	invalidateLevels()
 	return
 }
 
+func (handler *BasicHandler) needsCaller() bool {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	return handler.needCaller
+}
+
 func (handler *BasicHandler) getLogLevel() LogLevel {
 	handler.mu.Lock()
 	defer handler.mu.Unlock()
 	return handler.logConfig.logLevel
 }
 
+// Close closes the log file right away, even if loggers still hold the
+// handler, later records are dropped with ErrHandlerClosed. Use Release to
+// leave the handler to the loggers holding it
 func (handler *BasicHandler) Close() {
 	handler.mu.Lock()
 	defer handler.mu.Unlock()
-	if handler.out != os.Stdout {
-		handler.out.Close()
+	handler.close()
+}
+
+// Release closes the handler when no logger holds it, otherwise the last
+// logger holding it closes it when that logger is closed or removes it
+func (handler *BasicHandler) Release() {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.released = true
+	if handler.owners == 0 {
+		handler.close()
+	}
+}
+
+func (handler *BasicHandler) close() {
+	if handler.closed {
+		return
+	}
+	if handler.flushTimer != nil {
+		handler.flushTimer.Stop()
+		handler.flushTimer = nil
+	}
+	handler.closeOut()
+	handler.waitArchive()
+	handler.closed = true
+}
+
+// retain is called when a logger starts holding the handler
+func (handler *BasicHandler) retain() {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.owners++
+}
+
+// release is called when a logger closes, the last owner closes the handler
+func (handler *BasicHandler) release() {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.owners--
+	if handler.owners <= 0 {
+		handler.owners = 0
+		handler.close()
+	}
+}
+
+// detach is called when a logger drops the handler without closing it, a
+// released handler is closed with its last owner
+func (handler *BasicHandler) detach() {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if handler.owners > 0 {
+		handler.owners--
+	}
+	if handler.owners == 0 && handler.released {
+		handler.close()
 	}
 }
 
@@ -131,18 +256,17 @@ func (handler *BasicHandler) getId() int {
 	return handler.id
 }
 
-func (handler *BasicHandler) writeLog(name string, logLevel LogLevel, format string, v ...interface{}) {
+func (handler *BasicHandler) writeLog(r *Record) (err error) {
 	handler.mu.Lock()
 	defer handler.mu.Unlock()
-	handler.formatter = baseFormatter()
-	handler.formatter.setName(name)
-	handler.formatter.setLevelName(logLevel)
-	handler.formatter.setMessage(fmt.Sprintf(format, v...))
-	value := []interface{}{}
-	for _, fun := range handler.formatFunc {
-		value = append(value, fun())
+	if !handler.checkDiskSpace(r.Level) {
+		return
 	}
-	fmt.Fprintf(handler.out, handler.formatString, value...)
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = handler.formatRecord(*buf, r)
+	err = handler.write(r.Level, handler.sealRecord(*buf), handler.setOut)
+	return
 }
 
 type RotatingHandler struct {
@@ -151,9 +275,21 @@ type RotatingHandler struct {
 	maxFileSize     int64
 	backupCount     int
 	currentFileSize int64
+	rotateOnStartup bool
+	startupRotated  bool
 }
 
 func GetRotatingHandler(fileDir, fileName string) (rotatingHandler *RotatingHandler, err error) {
+	return GetRotatingHandlerWithPermissions(fileDir, fileName, DefaultPermissions())
+}
+
+// GetRotatingHandlerWithPermissions creates the log file and its
+// directories with perm, no other user can open them meanwhile
+func GetRotatingHandlerWithPermissions(fileDir, fileName string, perm Permissions) (rotatingHandler *RotatingHandler, err error) {
+	err = perm.check()
+	if err != nil {
+		return
+	}
 	mutex.Lock()
 	defer mutex.Unlock()
 	rotatingHandler = new(RotatingHandler)
@@ -168,19 +304,19 @@ func GetRotatingHandler(fileDir, fileName string) (rotatingHandler *RotatingHand
 	rotatingHandler.id = handlerId
 	handlerId++
 	rotatingHandler.out = os.Stdout
+	rotatingHandler.fallback = os.Stderr
+	rotatingHandler.stackLevel = noLevel
+	rotatingHandler.setPermissions(perm)
 	err = rotatingHandler.setOut()
 	if err != nil {
 		return
 	}
-	rotatingHandler.formatter = baseFormatter()
 	rotatingHandler.setFormatter()
 	return
 }
 
 func (handler *RotatingHandler) setOut() (err error) {
-	if handler.out != os.Stdout {
-		handler.out.Close()
-	}
+	handler.closeOut()
 	if handler.logConfig.fileDir == "" {
 		handler.logConfig.fileDir = "."
 	}
@@ -193,7 +329,10 @@ func (handler *RotatingHandler) setOut() (err error) {
 			return
 		}
 		filepath := path.Join(handler.logConfig.fileDir, handler.logConfig.fileName)
-		handler.out, err = os.OpenFile(filepath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+		handler.out, err = handler.openFile(filepath)
+		if err != nil {
+			return
+		}
 		stat, err1 := os.Stat(filepath)
 		if err1 != nil {
 			err = err1
@@ -204,12 +343,25 @@ func (handler *RotatingHandler) setOut() (err error) {
 	return
 }
 
+// SetFilePath moves the handler to another file, with rotateOnStartup a
+// non-empty file is rotated as when the handler starts
 func (handler *RotatingHandler) SetFilePath(fileDir, fileName string) (err error) {
 	handler.mu.Lock()
 	defer handler.mu.Unlock()
 	handler.logConfig.fileDir = fileDir
 	handler.logConfig.fileName = fileName
 	err = handler.setOut()
+	if err != nil {
+		return
+	}
+	// colors depend on whether the new output is a terminal
+	err = handler.setFormatter()
+	if err != nil {
+		return
+	}
+	if handler.rotateOnStartup && handler.currentFileSize > 0 {
+		err = handler.doRorate()
+	}
 	return
 }
 
@@ -233,23 +385,26 @@ func (handler *RotatingHandler) SetBackupCount(count int) (err error) {
 	return
 }
 
-func (handler *RotatingHandler) writeLog(name string, logLevel LogLevel, format string, v ...interface{}) {
+func (handler *RotatingHandler) writeLog(r *Record) (err error) {
 	handler.mu.Lock()
 	defer handler.mu.Unlock()
-	handler.formatter = baseFormatter()
-	handler.formatter.setName(name)
-	handler.formatter.setLevelName(logLevel)
-	handler.formatter.setMessage(fmt.Sprintf(format, v...))
-	value := []interface{}{}
-	for _, fun := range handler.formatFunc {
-		value = append(value, fun())
+	if !handler.checkDiskSpace(r.Level) {
+		return
 	}
-	s := fmt.Sprintf(handler.formatString, value...)
-	if int64(len(s))+handler.currentFileSize > handler.maxFileSize {
-		handler.doRorate()
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = handler.formatRecord(*buf, r)
+	if int64(len(*buf))+handler.currentFileSize > handler.maxFileSize && !handler.broken && !handler.closed {
+		err := handler.doRorate()
+		if err != nil {
+			handler.setBroken(err)
+			handler.reportError(err)
+		}
 	}
-	handler.currentFileSize += int64(len(s))
-	io.WriteString(handler.out, s)
+	line := handler.sealRecord(*buf)
+	handler.currentFileSize += int64(len(line))
+	err = handler.write(r.Level, line, handler.setOut)
+	return
 }
 
 func IsPathExists(path string) (bool, error) {
@@ -266,8 +421,7 @@ func IsPathExists(path string) (bool, error) {
 func getMaxLogNum(fileName string) (num int) {
 	num = 1
 	for ; ; num++ {
-		result, _ := IsPathExists(fileName + "." + strconv.Itoa(num))
-		if !result {
+		if !backupExists(fileName + "." + strconv.Itoa(num)) {
 			break
 		}
 	}
@@ -282,38 +436,97 @@ func min(a, b int) int {
 	}
 }
 
-func (handler *RotatingHandler) doRorate() {
-	handler.out.Close()
+func (handler *RotatingHandler) doRorate() (err error) {
+	handler.closeOut()
+	// the backups are shifted, so the previous one must be encrypted first
+	handler.waitArchive()
 	filepath := path.Join(handler.logConfig.fileDir, handler.logConfig.fileName)
 	for i := min(handler.backupCount, getMaxLogNum(filepath)); i >= 1; i-- {
 		sfn := ""
 		if i == 1 {
 			sfn = filepath
 		} else {
-			sfn = filepath + "." + strconv.Itoa(i-1)
+			sfn = archiveName(filepath + "." + strconv.Itoa(i-1))
 		}
 		dfn := filepath + "." + strconv.Itoa(i)
 		exist, _ := IsPathExists(sfn)
 		if exist {
-			os.Rename(sfn, dfn)
+			// the backup dropped may be encrypted or not, whatever sfn is
+			os.Remove(dfn)
+			os.Remove(dfn + archiveSuffix)
+			if strings.HasSuffix(sfn, archiveSuffix) {
+				dfn += archiveSuffix
+			}
+			err = os.Rename(sfn, dfn)
+			if err != nil {
+				return
+			}
 		}
 	}
-	handler.out, _ = os.OpenFile(filepath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
-	stat, _ := os.Stat(filepath)
+	if exist, _ := IsPathExists(filepath + ".1"); exist {
+		handler.encryptBackup(filepath+".1", nil)
+	}
+	handler.out, err = handler.openFile(filepath)
+	if err != nil {
+		return
+	}
+	stat, err := os.Stat(filepath)
+	if err != nil {
+		return
+	}
 	handler.currentFileSize = stat.Size()
+	return
+}
+
+// Rotate forces a rollover of the current log file regardless of its size
+func (handler *RotatingHandler) Rotate() (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if handler.closed {
+		return ErrHandlerClosed
+	}
+	return handler.doRorate()
+}
+
+// SetRotateOnStartup makes the handler start with a fresh file, the existing
+// non-empty log file is rotated once when the option is turned on and a
+// file set later by SetFilePath is rotated as well
+func (handler *RotatingHandler) SetRotateOnStartup(rotate bool) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.rotateOnStartup = rotate
+	if rotate && !handler.startupRotated {
+		handler.startupRotated = true
+		if handler.currentFileSize > 0 {
+			err = handler.doRorate()
+		}
+	}
+	return
 }
 
 type TimeRotatingHandler struct {
 	BasicHandler
-	splitType   SplitType
-	backupCount int
-	when        string
-	createTime  time.Time
-	rotateTime  time.Time
-	fileTag     string
+	splitType       SplitType
+	backupCount     int
+	when            string
+	createTime      time.Time
+	rotateTime      time.Time
+	fileTag         string
+	rotateOnStartup bool
+	startupRotated  bool
 }
 
 func GetTimeRotatingHandler(fileDir, fileName string) (timerotatingHandler *TimeRotatingHandler, err error) {
+	return GetTimeRotatingHandlerWithPermissions(fileDir, fileName, DefaultPermissions())
+}
+
+// GetTimeRotatingHandlerWithPermissions creates the log file and its
+// directories with perm, no other user can open them meanwhile
+func GetTimeRotatingHandlerWithPermissions(fileDir, fileName string, perm Permissions) (timerotatingHandler *TimeRotatingHandler, err error) {
+	err = perm.check()
+	if err != nil {
+		return
+	}
 	mutex.Lock()
 	defer mutex.Unlock()
 	timerotatingHandler = new(TimeRotatingHandler)
@@ -328,11 +541,13 @@ func GetTimeRotatingHandler(fileDir, fileName string) (timerotatingHandler *Time
 	timerotatingHandler.id = handlerId
 	handlerId++
 	timerotatingHandler.out = os.Stdout
+	timerotatingHandler.fallback = os.Stderr
+	timerotatingHandler.stackLevel = noLevel
+	timerotatingHandler.setPermissions(perm)
 	err = timerotatingHandler.setOut()
 	if err != nil {
 		return
 	}
-	timerotatingHandler.formatter = baseFormatter()
 	timerotatingHandler.setFormatter()
 	timerotatingHandler.rotateTime = getRotateTime(timerotatingHandler.createTime, timerotatingHandler.when)
 	timerotatingHandler.fileTag = getFileTag(timerotatingHandler.createTime, timerotatingHandler.when)
@@ -364,9 +579,7 @@ func (handler *TimeRotatingHandler) SetWhen(when string) (err error) {
 }
 
 func (handler *TimeRotatingHandler) setOut() (err error) {
-	if handler.out != os.Stdout {
-		handler.out.Close()
-	}
+	handler.closeOut()
 	if handler.logConfig.fileDir == "" {
 		handler.logConfig.fileDir = "."
 	}
@@ -379,11 +592,15 @@ func (handler *TimeRotatingHandler) setOut() (err error) {
 			return
 		}
 		filepath := path.Join(handler.logConfig.fileDir, handler.logConfig.fileName)
-		handler.out, err = os.OpenFile(filepath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+		handler.out, err = handler.openFile(filepath)
 		if err != nil {
 			return
 		}
-		handler.createTime,err = GetBirthtime(filepath)
+		handler.createTime, err = GetBirthtime(filepath)
+		if err != nil {
+			return
+		}
+		err = saveBirthtime(filepath, handler.createTime)
 		if err != nil {
 			return
 		}
@@ -391,52 +608,24 @@ func (handler *TimeRotatingHandler) setOut() (err error) {
 	return
 }
 
-func getField(stat syscall.Stat_t,name string) (result syscall.Timespec,ok bool){
-    t := reflect.TypeOf(stat)
-    _,ok = t.FieldByName(name)
-    if !ok{
-        return
-    }
-    v := reflect.ValueOf(stat)
-    v = v.FieldByName(name)
-    result = (v.Interface()).(syscall.Timespec)
-    return
-}
-
-func GetBirthtime(fileName string)(t time.Time, err error){
-    fileInfo, err := os.Stat(fileName)
-    if err!=nil{
-        return
-    }
-    stat := fileInfo.Sys().(*syscall.Stat_t)
-    timeName :=[]string{"Birthtimespec","Ctim","Ctimespec"}
-    for _,name := range timeName{
-        result,ok:=getField(*stat,name)
-        if ok{
-            t=time.Unix(result.Sec,0)
-            return
-        }
-    }
-    t=time.Now()
-    return
-}
-
-func (handler *TimeRotatingHandler) writeLog(name string, logLevel LogLevel, format string, v ...interface{}) {
+func (handler *TimeRotatingHandler) writeLog(r *Record) (err error) {
 	handler.mu.Lock()
 	defer handler.mu.Unlock()
-	handler.formatter = baseFormatter()
-	handler.formatter.setName(name)
-	handler.formatter.setLevelName(logLevel)
-	handler.formatter.setMessage(fmt.Sprintf(format, v...))
-	value := []interface{}{}
-	for _, fun := range handler.formatFunc {
-		value = append(value, fun())
+	if !handler.checkDiskSpace(r.Level) {
+		return
 	}
-	s := fmt.Sprintf(handler.formatString, value...)
-	if handler.checkRorate() {
-		handler.doRorate()
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = handler.formatRecord(*buf, r)
+	if handler.checkRorate() && !handler.broken && !handler.closed {
+		err := handler.doRorate()
+		if err != nil {
+			handler.setBroken(err)
+			handler.reportError(err)
+		}
 	}
-	io.WriteString(handler.out, s)
+	err = handler.write(r.Level, handler.sealRecord(*buf), handler.setOut)
+	return
 }
 
 func getFileTag(begin time.Time, when string) (fileTag string) {
@@ -488,22 +677,29 @@ func WalkDir(dirPth, prefix string, when string) (files []string, err error) {
 		dirPth = "."
 	}
 	restring := `^$`
+	prefix = regexp.QuoteMeta(prefix)
 	switch when[len(when)-1:] {
 	case "s":
-		restring = `^` + prefix + `\.` + `\d\d\d\d-\d\d-\d\d \d\d:\d\d:\d\d` + `$`
+		restring = `^` + prefix + `\.` + `\d\d\d\d-\d\d-\d\d \d\d:\d\d:\d\d` + `(\.\d+)?(\.enc)?$`
 	case "h":
-		restring = `^` + prefix + `\.` + `\d\d\d\d-\d\d-\d\d \d\d` + `$`
+		restring = `^` + prefix + `\.` + `\d\d\d\d-\d\d-\d\d \d\d` + `(\.\d+)?(\.enc)?$`
 	case "d":
-		restring = `^` + prefix + `\.` + `\d\d\d\d-\d\d-\d\d` + `$`
+		restring = `^` + prefix + `\.` + `\d\d\d\d-\d\d-\d\d` + `(\.\d+)?(\.enc)?$`
 	default:
 		restring = `^$`
 	}
 	reg := regexp.MustCompile(restring)
 	err = filepath.Walk(dirPth, func(filename string, fi os.FileInfo, err error) error { //遍历目录
-		if fi.IsDir() { // 忽略目录
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() { // 忽略子目录
+			if filename != dirPth {
+				return filepath.SkipDir
+			}
 			return nil
 		}
-		if reg.MatchString(filename) {
+		if reg.MatchString(fi.Name()) {
 			files = append(files, filename)
 		}
 		return nil
@@ -511,20 +707,151 @@ func WalkDir(dirPth, prefix string, when string) (files []string, err error) {
 	return files, err
 }
 
-func (handler *TimeRotatingHandler) doRorate() {
-	handler.out.Close()
-	sfn := path.Join(handler.logConfig.fileDir, handler.logConfig.fileName)
-	dfn := path.Join(handler.logConfig.fileDir, handler.logConfig.fileName+"."+handler.fileTag)
-	os.Rename(sfn, dfn)
-	files, _ := WalkDir(handler.logConfig.fileDir, handler.logConfig.fileName, handler.when)
-	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+// getBackupName returns fileName, or fileName with a number above the
+// backups of the same period already kept, so the new backup is always the
+// newest one for the retention
+func getBackupName(fileName string) (backupName string) {
+	infos, _ := ioutil.ReadDir(path.Dir(fileName))
+	number := -1
+	for _, info := range infos {
+		tag, n := splitBackupNumber(info.Name())
+		if tag == path.Base(fileName) && n > number {
+			number = n
+		}
+	}
+	if number < 0 {
+		return fileName
+	}
+	return fileName + "." + strconv.Itoa(number+1)
+}
+
+// splitBackupNumber splits the name of a time backup, or of its archive,
+// into the name with the period and the number of the backup in the period,
+// 0 when it has none
+func splitBackupNumber(name string) (tag string, n int) {
+	tag = trimArchiveSuffix(name)
+	i := strings.LastIndexByte(tag, '.')
+	if i < 0 {
+		return
+	}
+	n, err := strconv.Atoi(tag[i+1:])
+	if err != nil || n < 0 {
+		return tag, 0
+	}
+	return tag[:i], n
+}
+
+// removeOldBackups keeps the backupCount newest backups of fileName
+func removeOldBackups(fileDir, fileName, when string, backupCount int) {
+	files, _ := WalkDir(fileDir, fileName, when)
+	// newest first, by period then by number, an encrypted backup sorts as
+	// the backup it holds
+	sort.Slice(files, func(i, j int) bool {
+		tagI, nI := splitBackupNumber(path.Base(files[i]))
+		tagJ, nJ := splitBackupNumber(path.Base(files[j]))
+		if tagI != tagJ {
+			return tagI > tagJ
+		}
+		return nI > nJ
+	})
 	for i := range files {
-		if i >= handler.backupCount {
+		if i >= backupCount {
 			os.Remove(files[i])
 		}
 	}
-	handler.out, _ = os.OpenFile(sfn, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+}
+
+func (handler *TimeRotatingHandler) doRorate() (err error) {
+	handler.closeOut()
+	handler.waitArchive()
+	sfn := path.Join(handler.logConfig.fileDir, handler.logConfig.fileName)
+	// a manual rotation can happen several times inside one period, keep the
+	// earlier backups of the same period instead of overwriting them
+	dfn := getBackupName(path.Join(handler.logConfig.fileDir, handler.logConfig.fileName+"."+handler.fileTag))
+	fileDir, fileName, when, backupCount := handler.logConfig.fileDir, handler.logConfig.fileName, handler.when, handler.backupCount
+	removeBackups := func() {
+		removeOldBackups(fileDir, fileName, when, backupCount)
+	}
+	err = os.Rename(sfn, dfn)
+	if err == nil {
+		// the retention counts the backup once it is encrypted
+		handler.encryptBackup(dfn, removeBackups)
+	} else if os.IsNotExist(err) {
+		handler.waitArchive()
+		removeBackups()
+	} else {
+		return
+	}
+	handler.out, err = handler.openFile(sfn)
+	if err != nil {
+		return
+	}
 	handler.createTime = time.Now()
 	handler.rotateTime = getRotateTime(handler.createTime, handler.when)
 	handler.fileTag = getFileTag(handler.createTime, handler.when)
+	err = saveBirthtime(sfn, handler.createTime)
+	return
+}
+
+// Rotate forces a rollover of the current log file before the next period
+func (handler *TimeRotatingHandler) Rotate() (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if handler.closed {
+		return ErrHandlerClosed
+	}
+	return handler.doRorate()
+}
+
+// SetFilePath moves the handler to another file, the rotation time follows
+// the creation time of the new file. With rotateOnStartup a non-empty file
+// is rotated as when the handler starts
+func (handler *TimeRotatingHandler) SetFilePath(fileDir, fileName string) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.logConfig.fileDir = fileDir
+	handler.logConfig.fileName = fileName
+	err = handler.setOut()
+	if err != nil {
+		return
+	}
+	err = handler.setFormatter()
+	if err != nil {
+		return
+	}
+	handler.rotateTime = getRotateTime(handler.createTime, handler.when)
+	handler.fileTag = getFileTag(handler.createTime, handler.when)
+	if handler.rotateOnStartup {
+		stat, err1 := os.Stat(path.Join(fileDir, fileName))
+		if err1 != nil {
+			err = err1
+			return
+		}
+		if stat.Size() > 0 {
+			err = handler.doRorate()
+		}
+	}
+	return
+}
+
+// SetRotateOnStartup makes the handler start with a fresh file, the existing
+// non-empty log file is rotated once when the option is turned on and a
+// file set later by SetFilePath is rotated as well
+func (handler *TimeRotatingHandler) SetRotateOnStartup(rotate bool) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.rotateOnStartup = rotate
+	if rotate && !handler.startupRotated {
+		handler.startupRotated = true
+		filepath := path.Join(handler.logConfig.fileDir, handler.logConfig.fileName)
+		stat, err1 := os.Stat(filepath)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		if stat.Size() > 0 {
+			err = handler.doRorate()
+		}
+	}
+	return
 }
@@ -0,0 +1,225 @@
+package logging
+
+import "encoding/json"
+import "fmt"
+import "math"
+import "strconv"
+import "strings"
+import "time"
+import "unicode/utf8"
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s as a JSON string, invalid UTF-8 is replaced by
+// U+FFFD
+func appendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				buf = append(buf, '\\', c)
+			case c == '\n':
+				buf = append(buf, '\\', 'n')
+			case c == '\r':
+				buf = append(buf, '\\', 'r')
+			case c == '\t':
+				buf = append(buf, '\\', 't')
+			case c < ' ' || c == 0x7f:
+				buf = append(buf, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			default:
+				buf = append(buf, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, `\ufffd`...)
+		} else if r == '\u2028' || r == '\u2029' {
+			// valid JSON but line breaks for javascript
+			buf = append(buf, `\u202`...)
+			buf = append(buf, hexDigits[r&0xf])
+		} else {
+			buf = append(buf, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(buf, '"')
+}
+
+// appendJSONValue appends a field value, numbers and booleans are kept as
+// they are and other values become strings unless encoding/json knows them
+func appendJSONValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, "null"...)
+	case string:
+		return appendJSONString(buf, v)
+	case bool:
+		return strconv.AppendBool(buf, v)
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(buf, v, 10)
+	case int32:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case uint:
+		return strconv.AppendUint(buf, uint64(v), 10)
+	case uint64:
+		return strconv.AppendUint(buf, v, 10)
+	case uint32:
+		return strconv.AppendUint(buf, uint64(v), 10)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return appendJSONString(buf, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		return strconv.AppendFloat(buf, v, 'g', -1, 64)
+	case float32:
+		return appendJSONValue(buf, float64(v))
+	case []byte, time.Time, time.Duration, error, fmt.Stringer:
+		return appendJSONString(buf, string(appendFieldValue(nil, v)))
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return appendJSONString(buf, fmt.Sprint(value))
+	}
+	return append(buf, data...)
+}
+
+// appendJSONPair appends ,"key":value to an object holding other pairs
+func appendJSONPair(buf []byte, key string, value interface{}) []byte {
+	buf = append(buf, ',')
+	buf = appendJSONString(buf, key)
+	buf = append(buf, ':')
+	return appendJSONValue(buf, value)
+}
+
+// GELFEncoder writes records as GELF 1.1 JSON messages for Graylog, fields
+// become additional fields prefixed with "_"
+type GELFEncoder struct {
+	Host string // hostname of the machine when empty
+}
+
+// gelfLevel maps a level to its syslog severity
+func gelfLevel(logLevel LogLevel) int {
+	switch logLevel {
+	case DEBUG:
+		return 7
+	case WARNING:
+		return 4
+	default:
+		return 3
+	}
+}
+
+// gelfFieldName makes key a valid additional field name, "_id" is reserved
+// by GELF and becomes "_id_"
+func gelfFieldName(key string) string {
+	name := []byte{'_'}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-') {
+			c = '_'
+		}
+		name = append(name, c)
+	}
+	if string(name) == "_id" {
+		return "_id_"
+	}
+	return string(name)
+}
+
+func (encoder *GELFEncoder) Encode(buf []byte, r *Record) []byte {
+	host := encoder.Host
+	if host == "" {
+		host = hostname
+	}
+	buf = append(buf, `{"version":"1.1","host":`...)
+	buf = appendJSONString(buf, host)
+	buf = append(buf, `,"short_message":`...)
+	buf = appendJSONString(buf, r.Message)
+	buf = append(buf, `,"timestamp":`...)
+	buf = strconv.AppendInt(buf, r.Time.Unix(), 10)
+	buf = append(buf, '.')
+	buf = appendInt(buf, r.Time.Nanosecond()/1e6, 3)
+	buf = append(buf, `,"level":`...)
+	buf = strconv.AppendInt(buf, int64(gelfLevel(r.Level)), 10)
+	buf = append(buf, `,"_logger":`...)
+	buf = appendJSONString(buf, r.Name)
+	if r.PathName != "" {
+		buf = appendJSONPair(buf, "_file", r.PathName)
+		buf = appendJSONPair(buf, "_line", r.LineNo)
+		buf = appendJSONPair(buf, "_function", r.FuncName)
+	}
+	if r.Stack != "" {
+		buf = appendJSONPair(buf, "_stack", r.Stack)
+	}
+	for _, field := range r.Fields {
+		buf = appendJSONPair(buf, gelfFieldName(field.Key), field.Value)
+	}
+	return append(buf, '}')
+}
+
+// ECSEncoder writes records as JSON following the Elastic Common Schema,
+// fields are written at the top level under their own names, like
+// "user.id", unless they clash with a field of the encoder
+type ECSEncoder struct{}
+
+const ecsVersion = "1.6.0"
+
+// ecsKeys are the fields written by ECSEncoder
+var ecsKeys = []string{"@timestamp", "log.level", "message", "ecs.version", "log.logger", "log.origin.file.name",
+	"log.origin.file.line", "log.origin.function", "process.pid", "host.hostname", "error.message", "error.type",
+	"error.stack_trace"}
+
+// ecsFieldName moves key under "labels." when it is a field of the encoder,
+// holds one, like "log", or is inside one, like "message.text"
+func ecsFieldName(key string) string {
+	for _, reserved := range ecsKeys {
+		if key == reserved || isDottedPrefix(key, reserved) || isDottedPrefix(reserved, key) {
+			return "labels." + key
+		}
+	}
+	return key
+}
+
+// isDottedPrefix tells whether name is inside the object prefix, as
+// "log.level" is inside "log"
+func isDottedPrefix(prefix string, name string) bool {
+	return len(name) > len(prefix) && name[len(prefix)] == '.' && strings.HasPrefix(name, prefix)
+}
+
+func (encoder *ECSEncoder) Encode(buf []byte, r *Record) []byte {
+	buf = append(buf, `{"@timestamp":"`...)
+	buf = r.Time.UTC().AppendFormat(buf, "2006-01-02T15:04:05.000000Z")
+	buf = append(buf, `","log.level":"`...)
+	buf = append(buf, strings.ToLower(r.Level.String())...)
+	buf = append(buf, `","message":`...)
+	buf = appendJSONString(buf, r.Message)
+	buf = append(buf, `,"ecs.version":"`+ecsVersion+`","log.logger":`...)
+	buf = appendJSONString(buf, r.Name)
+	if r.PathName != "" {
+		buf = appendJSONPair(buf, "log.origin.file.name", r.FileName())
+		buf = appendJSONPair(buf, "log.origin.file.line", r.LineNo)
+		buf = appendJSONPair(buf, "log.origin.function", r.FuncName)
+	}
+	buf = appendJSONPair(buf, "process.pid", processId)
+	buf = appendJSONPair(buf, "host.hostname", hostname)
+	if r.Err != nil {
+		buf = appendJSONPair(buf, "error.message", r.Err.Error())
+		err := r.Err
+		if redacted, ok := err.(*redactedError); ok {
+			err = redacted.err
+		}
+		buf = appendJSONPair(buf, "error.type", fmt.Sprintf("%T", err))
+	}
+	if r.Stack != "" {
+		buf = appendJSONPair(buf, "error.stack_trace", r.Stack)
+	}
+	for _, field := range r.Fields {
+		buf = appendJSONPair(buf, ecsFieldName(field.Key), field.Value)
+	}
+	return append(buf, '}')
+}
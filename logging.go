@@ -1,6 +1,8 @@
 package logging
 
 import "sync"
+import "sync/atomic"
+import "time"
 
 type SplitType int
 
@@ -17,62 +19,245 @@ const (
 	ERROR
 )
 
+func (logLevel LogLevel) String() string {
+	switch logLevel {
+	case DEBUG:
+		return "DEBUG"
+	case WARNING:
+		return "WARNING"
+	default:
+		return "ERROR"
+	}
+}
+
 type FileLogger struct {
 	name       string
 	mu         *sync.Mutex
-	logHandler []*LogHandler
+	logHandler atomic.Value // []*LogHandler, replaced as a whole under mu
+	generation int64        // levelGeneration the cache was computed for
+	cache      int32        // loggerLevels packed by pack()
+	base       *FileLogger  // the registered logger behind a WithCallerSkip view
+	callerSkip int
+	fields     []Field // added by With to each record
 }
 
 var globalLogMap = make(map[string]*FileLogger)
 var mutex = new(sync.Mutex)
 var handlerId = 1
 
-func (fl *FileLogger) Debug(format string, v ...interface{}) {
-	for _, value := range fl.logHandler {
-		if (*value).getLogLevel() <= DEBUG {
-			(*value).writeLog(fl.name, DEBUG, format, v...)
+// levelGeneration is bumped whenever a handler level, a format string or the
+// handlers of a logger change, loggers then recompute their cached level
+var levelGeneration int64
+
+// noLevel is the effective level of a logger without handlers
+const noLevel = ERROR + 1
+
+func invalidateLevels() {
+	atomic.AddInt64(&levelGeneration, 1)
+}
+
+// root returns the registered logger holding the handlers and levels
+func (fl *FileLogger) root() *FileLogger {
+	if fl.base != nil {
+		return fl.base
+	}
+	return fl
+}
+
+// WithCallerSkip returns a view of the logger which reports the caller n
+// frames further up the stack, for libraries wrapping FileLogger. The view
+// shares the handlers of the logger
+func (fl *FileLogger) WithCallerSkip(n int) *FileLogger {
+	return &FileLogger{name: fl.name, base: fl.root(), callerSkip: fl.callerSkip + n, fields: fl.fields}
+}
+
+// loggerLevels is what a logger caches about its handlers
+type loggerLevels struct {
+	level      LogLevel // lowest level taken by a handler
+	stackLevel LogLevel // lowest level a handler wants a stack trace for
+	needCaller bool
+}
+
+func (levels loggerLevels) pack() int32 {
+	cache := int32(levels.level) | int32(levels.stackLevel)<<4
+	if levels.needCaller {
+		cache |= 1 << 8
+	}
+	return cache
+}
+
+func unpackLevels(cache int32) loggerLevels {
+	return loggerLevels{
+		level:      LogLevel(cache & 0xf),
+		stackLevel: LogLevel(cache >> 4 & 0xf),
+		needCaller: cache>>8&1 == 1,
+	}
+}
+
+func (fl *FileLogger) effectiveLevel() (levels loggerLevels) {
+	fl = fl.root()
+	generation := atomic.LoadInt64(&levelGeneration)
+	if atomic.LoadInt64(&fl.generation) != generation {
+		fl.mu.Lock()
+		levels = loggerLevels{level: noLevel, stackLevel: noLevel}
+		for _, value := range fl.getHandlers() {
+			if handlerLevel := (*value).getLogLevel(); handlerLevel < levels.level {
+				levels.level = handlerLevel
+			}
+			if stackLevel := (*value).getStackLevel(); stackLevel < levels.stackLevel {
+				levels.stackLevel = stackLevel
+			}
+			levels.needCaller = levels.needCaller || (*value).needsCaller()
 		}
+		atomic.StoreInt32(&fl.cache, levels.pack())
+		atomic.StoreInt64(&fl.generation, generation)
+		fl.mu.Unlock()
+		return
 	}
+	return unpackLevels(atomic.LoadInt32(&fl.cache))
 }
 
-func (fl *FileLogger) Warning(format string, v ...interface{}) {
-	for _, value := range fl.logHandler {
-		if (*value).getLogLevel() <= WARNING {
-			(*value).writeLog(fl.name, WARNING, format, v...)
+// Enabled reports whether a record of logLevel would reach any handler, use
+// it to skip building expensive arguments
+func (fl *FileLogger) Enabled(logLevel LogLevel) bool {
+	return logLevel >= fl.effectiveLevel().level
+}
+
+var recordPool = sync.Pool{
+	New: func() interface{} {
+		return new(Record)
+	},
+}
+
+// log builds one record shared by every handler, the message is formatted
+// only when some handler takes the level
+func (fl *FileLogger) log(logLevel LogLevel, err error, format string, v ...interface{}) {
+	if isShutdown() {
+		if err != nil {
+			format, v = "%s: %s", []interface{}{formatMessage(format, v...), err}
 		}
+		writeAfterShutdown(fl.name, logLevel, format, v...)
+		return
+	}
+	levels := fl.effectiveLevel()
+	if logLevel < levels.level {
+		return
+	}
+	r := recordPool.Get().(*Record)
+	*r = Record{Name: fl.name, Level: logLevel, Time: time.Now(), Message: formatMessage(format, v...), Err: err, Fields: fl.fields}
+	if err != nil && r.Message != "" {
+		r.Message += ": " + err.Error()
+	} else if err != nil {
+		r.Message = err.Error()
 	}
+	if levels.needCaller {
+		r.setCaller(2 + fl.callerSkip)
+	}
+	if logLevel >= levels.stackLevel || err != nil {
+		r.setStack(2+fl.callerSkip, err)
+	}
+	fl.dispatch(r)
+	*r = Record{}
+	recordPool.Put(r)
 }
 
-func (fl *FileLogger) Error(format string, v ...interface{}) {
-	for _, value := range fl.logHandler {
-		if (*value).getLogLevel() <= ERROR {
-			(*value).writeLog(fl.name, ERROR, format, v...)
+// dispatch gives r to every handler taking its level
+func (fl *FileLogger) dispatch(r *Record) {
+	for _, value := range fl.getHandlers() {
+		if (*value).getLogLevel() <= r.Level {
+			(*value).writeLog(r)
 		}
 	}
 }
 
+func (fl *FileLogger) Debug(format string, v ...interface{}) {
+	fl.log(DEBUG, nil, format, v...)
+}
+
+func (fl *FileLogger) Warning(format string, v ...interface{}) {
+	fl.log(WARNING, nil, format, v...)
+}
+
+func (fl *FileLogger) Error(format string, v ...interface{}) {
+	fl.log(ERROR, nil, format, v...)
+}
+
+// ErrorErr logs an ERROR record for err, like exc_info in python the record
+// carries the stack trace of the call and any stack held by the error chain
+func (fl *FileLogger) ErrorErr(err error, format string, v ...interface{}) {
+	fl.log(ERROR, err, format, v...)
+}
+
+// Close releases the handlers of the logger, a handler is closed once no
+// other logger holds it
 func (fl *FileLogger) Close() {
-	for _, value := range fl.logHandler {
-		(*value).Close()
+	fl = fl.root()
+	fl.mu.Lock()
+	logHandler := fl.getHandlers()
+	fl.logHandler.Store([]*LogHandler{})
+	fl.mu.Unlock()
+	invalidateLevels()
+	for _, value := range logHandler {
+		(*value).release()
+	}
+}
+
+// Flush writes the buffered records of every handler to their files
+func (fl *FileLogger) Flush() (err error) {
+	for _, value := range fl.getHandlers() {
+		err1 := (*value).Flush()
+		if err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	return
+}
+
+// Sync flushes every handler and commits their files to stable storage
+func (fl *FileLogger) Sync() (err error) {
+	for _, value := range fl.getHandlers() {
+		err1 := (*value).Sync()
+		if err1 != nil && err == nil {
+			err = err1
+		}
 	}
+	return
+}
+
+// getHandlers returns the current handler list without locking, the list is
+// never modified in place so it can be ranged over while handlers change
+func (fl *FileLogger) getHandlers() []*LogHandler {
+	fl = fl.root()
+	logHandler, _ := fl.logHandler.Load().([]*LogHandler)
+	return logHandler
 }
 
 func (fl *FileLogger) AddHandler(handler LogHandler) {
+	fl = fl.root()
 	fl.mu.Lock()
 	defer fl.mu.Unlock()
-	fl.logHandler = append(fl.logHandler, &handler)
+	handler.retain()
+	oldHandler := fl.getHandlers()
+	logHandler := make([]*LogHandler, len(oldHandler), len(oldHandler)+1)
+	copy(logHandler, oldHandler)
+	fl.logHandler.Store(append(logHandler, &handler))
+	invalidateLevels()
 }
 
 func (fl *FileLogger) RemoveHandler(handler LogHandler) {
+	fl = fl.root()
 	fl.mu.Lock()
 	defer fl.mu.Unlock()
 	logHandler := []*LogHandler{}
-	for _, _handler := range fl.logHandler {
+	for _, _handler := range fl.getHandlers() {
 		if (*_handler).getId() != handler.getId() {
 			logHandler = append(logHandler, _handler)
+		} else {
+			(*_handler).detach()
 		}
 	}
-	fl.logHandler = logHandler
+	fl.logHandler.Store(logHandler)
+	invalidateLevels()
 }
 
 func GetLogger(logname string) (logger *FileLogger) {
@@ -80,8 +265,42 @@ func GetLogger(logname string) (logger *FileLogger) {
 	defer mutex.Unlock()
 	logger, ok := globalLogMap[logname]
 	if !ok {
-		logger = &FileLogger{name: logname, mu: new(sync.Mutex), logHandler: []*LogHandler{}}
+		logger = &FileLogger{name: logname, mu: new(sync.Mutex), generation: -1}
+		logger.logHandler.Store([]*LogHandler{})
 		globalLogMap[logname] = logger
 	}
 	return
 }
+
+type rotater interface {
+	Rotate() error
+}
+
+// RotateAll forces a rollover on every rotating handler installed on a
+// registered logger, handlers shared by several loggers are rotated once and
+// closed handlers are skipped
+func RotateAll() (err error) {
+	mutex.Lock()
+	loggers := []*FileLogger{}
+	for _, logger := range globalLogMap {
+		loggers = append(loggers, logger)
+	}
+	mutex.Unlock()
+	rotated := map[int]bool{}
+	for _, logger := range loggers {
+		for _, handler := range logger.getHandlers() {
+			id := (*handler).getId()
+			if rotated[id] {
+				continue
+			}
+			rotated[id] = true
+			if r, ok := (*handler).(rotater); ok {
+				err1 := r.Rotate()
+				if err1 != nil && err1 != ErrHandlerClosed && err == nil {
+					err = err1
+				}
+			}
+		}
+	}
+	return
+}
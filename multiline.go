@@ -0,0 +1,127 @@
+package logging
+
+import "errors"
+import "unicode/utf8"
+
+// MultilinePolicy tells the text formatter what to do with line breaks and
+// other control characters in the values of tokens, a message holding "\n"
+// could otherwise forge records for line based parsers. Encoders always
+// escape their values and ignore the policy
+type MultilinePolicy int
+
+const (
+	// MultilineEscape writes control characters as \n, \r, \x1b... so each
+	// record stays on one line. %(stack) is indented instead
+	MultilineEscape MultilinePolicy = iota
+	// MultilineIndent starts each continuation line with four spaces, other
+	// control characters are escaped
+	MultilineIndent
+	// MultilineEncode writes each record as a JSON object, the formatted
+	// record is the string "record" and the stack trace, when the record
+	// has one, the string "stack" instead of the place of %(stack)
+	MultilineEncode
+	// MultilineRaw writes values as they are
+	MultilineRaw
+)
+
+const continuationIndent = "    "
+
+// SetMultilinePolicy sets how the format string writes values holding
+// line breaks, by default they are escaped
+func (handler *BasicHandler) SetMultilinePolicy(policy MultilinePolicy) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if policy < MultilineEscape || policy > MultilineRaw {
+		err = errors.New("error multiline policy")
+		return
+	}
+	oldPolicy := handler.multiline
+	handler.multiline = policy
+	err = handler.setFormatter()
+	if err != nil {
+		handler.multiline = oldPolicy
+	}
+	return
+}
+
+// unsafeAt returns the length of the control character at the start of p,
+// 0 when there is none
+func unsafeAt(p []byte) int {
+	c := p[0]
+	if c < ' ' && c != '\t' || c == 0x7f {
+		return 1
+	}
+	if c == 0xc2 && len(p) > 1 && p[1] == 0x85 {
+		return 2
+	}
+	if c == 0xe2 && len(p) > 2 && p[1] == 0x80 && (p[2] == 0xa8 || p[2] == 0xa9) {
+		return 3
+	}
+	return 0
+}
+
+func hasUnsafe(p []byte) bool {
+	for i := range p {
+		if p[i] < ' ' || p[i] == 0x7f || p[i] == 0xc2 || p[i] == 0xe2 {
+			if unsafeAt(p[i:]) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// appendEscaped appends p with its control characters escaped, line breaks
+// are indented instead when indent is set
+func appendEscaped(buf []byte, p []byte, indent bool) []byte {
+	for i := 0; i < len(p); {
+		n := unsafeAt(p[i:])
+		if n == 0 {
+			buf = append(buf, p[i])
+			i++
+			continue
+		}
+		switch {
+		case p[i] == '\n' && indent:
+			buf = append(buf, '\n')
+			buf = append(buf, continuationIndent...)
+		case p[i] == '\n':
+			buf = append(buf, '\\', 'n')
+		case p[i] == '\r':
+			buf = append(buf, '\\', 'r')
+		case n == 1:
+			buf = append(buf, '\\', 'x', hexDigits[p[i]>>4], hexDigits[p[i]&0xf])
+		default:
+			r, _ := utf8.DecodeRune(p[i:])
+			buf = append(buf, '\\', 'u', hexDigits[r>>12], hexDigits[r>>8&0xf], hexDigits[r>>4&0xf], hexDigits[r&0xf])
+		}
+		i += n
+	}
+	return buf
+}
+
+// sanitizeToken applies the policy to what token appends, the value is
+// only copied when it holds a control character
+func sanitizeToken(name string, token formatToken, policy MultilinePolicy) formatToken {
+	if policy == MultilineEncode && name == "stack" {
+		return func(buf []byte, r *Record) []byte {
+			return buf
+		}
+	}
+	if policy != MultilineEscape && policy != MultilineIndent {
+		return token
+	}
+	indent := policy == MultilineIndent || name == "stack"
+	return func(buf []byte, r *Record) []byte {
+		start := len(buf)
+		buf = token(buf, r)
+		if !hasUnsafe(buf[start:]) {
+			return buf
+		}
+		value := getBuffer()
+		*value = append(*value, buf[start:]...)
+		buf = appendEscaped(buf[:start], *value, indent)
+		putBuffer(value)
+		return buf
+	}
+}
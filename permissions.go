@@ -0,0 +1,241 @@
+package logging
+
+import "errors"
+import "os"
+import "os/user"
+import "path"
+import "strconv"
+
+// defaultFileMode and defaultDirMode are reduced by the umask, an explicit
+// mode is applied as it is
+const defaultFileMode os.FileMode = 0666
+const defaultDirMode os.FileMode = 0777
+
+// Permissions are the mode and the owner of the log files and of the
+// directories created for them, a zero mode is the default one reduced by
+// the umask and a -1 id keeps the id of the process
+type Permissions struct {
+	FileMode os.FileMode
+	DirMode  os.FileMode
+	Uid      int
+	Gid      int
+}
+
+// DefaultPermissions returns the permissions used by GetBasicHandler and the
+// other constructors
+func DefaultPermissions() Permissions {
+	return Permissions{Uid: -1, Gid: -1}
+}
+
+func (perm Permissions) check() (err error) {
+	if perm.FileMode != 0 {
+		err = checkMode("file", perm.FileMode)
+	}
+	if err == nil && perm.DirMode != 0 {
+		err = checkMode("dir", perm.DirMode)
+	}
+	if err == nil {
+		err = checkOwner(perm.Uid, perm.Gid)
+	}
+	return
+}
+
+func checkMode(kind string, mode os.FileMode) (err error) {
+	if mode&^os.ModePerm != 0 || mode == 0 {
+		err = errors.New("error " + kind + " mode " + mode.String())
+	}
+	return
+}
+
+func checkOwner(uid, gid int) (err error) {
+	if uid < -1 || gid < -1 {
+		err = errors.New("error owner " + strconv.Itoa(uid) + ":" + strconv.Itoa(gid))
+	}
+	return
+}
+
+// setPermissions is called by the constructors before the file is opened
+func (handler *BasicHandler) setPermissions(perm Permissions) {
+	handler.fileMode = perm.FileMode
+	handler.dirMode = perm.DirMode
+	handler.uid, handler.gid = perm.Uid, perm.Gid
+}
+
+// openFile opens the log file at filepath for appending, creating fileDir
+// when it is missing, and applies the mode and the owner of the handler
+func (handler *BasicHandler) openFile(filepath string) (file *os.File, err error) {
+	err = handler.mkdirAll(path.Dir(filepath))
+	if err != nil {
+		return
+	}
+	mode := handler.fileMode
+	if mode == 0 {
+		mode = defaultFileMode
+	}
+	file, err = os.OpenFile(filepath, os.O_APPEND|os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return
+	}
+	err = handler.applyPermissions(file)
+	if err == nil && handler.chain != nil {
+		err = handler.startChainFile(file)
+	}
+	if err != nil {
+		file.Close()
+		file = nil
+	}
+	return
+}
+
+func (handler *BasicHandler) applyPermissions(file *os.File) (err error) {
+	return handler.permissions().apply(file)
+}
+
+func (handler *BasicHandler) permissions() Permissions {
+	return Permissions{FileMode: handler.fileMode, DirMode: handler.dirMode, Uid: handler.uid, Gid: handler.gid}
+}
+
+// apply sets the file mode, when there is one, and the owner of file
+func (perm Permissions) apply(file *os.File) (err error) {
+	if perm.FileMode != 0 {
+		err = file.Chmod(perm.FileMode)
+		if err != nil {
+			return
+		}
+	}
+	if perm.Uid != -1 || perm.Gid != -1 {
+		err = file.Chown(perm.Uid, perm.Gid)
+	}
+	return
+}
+
+// mkdirAll creates dir and its missing parents, the directories created
+// are remembered so SetDirMode can fix their mode afterwards
+func (handler *BasicHandler) mkdirAll(dir string) (err error) {
+	missing := []string{}
+	for d := dir; ; d = path.Dir(d) {
+		if _, err1 := os.Stat(d); err1 == nil || d == "." || d == "/" {
+			break
+		}
+		missing = append(missing, d)
+	}
+	mode := handler.dirMode
+	if mode == 0 {
+		mode = defaultDirMode
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		err = os.Mkdir(missing[i], mode)
+		if os.IsExist(err) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if handler.dirMode != 0 {
+			err = os.Chmod(missing[i], handler.dirMode)
+			if err != nil {
+				return
+			}
+		}
+		handler.createdDirs = append(handler.createdDirs, missing[i])
+	}
+	return
+}
+
+// currentFile returns the log file the handler writes to, nil for stdout
+// or while the file can't be opened
+func (handler *BasicHandler) currentFile() *os.File {
+	file, ok := handler.out.(*os.File)
+	if !ok || file == nil || file == os.Stdout || handler.broken || handler.closed {
+		return nil
+	}
+	return file
+}
+
+// SetFileMode sets the permissions of the log file and of the files opened
+// after a rotation, backups keep the mode of the file they come from. The
+// current file was created with the previous mode, use
+// GetBasicHandlerWithPermissions and the like to create it with mode
+func (handler *BasicHandler) SetFileMode(mode os.FileMode) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	err = checkMode("file", mode)
+	if err != nil {
+		return
+	}
+	handler.fileMode = mode
+	if file := handler.currentFile(); file != nil {
+		err = file.Chmod(mode)
+	}
+	return
+}
+
+// SetDirMode sets the permissions of the directories created for the log
+// file, including the ones already created by the handler
+func (handler *BasicHandler) SetDirMode(mode os.FileMode) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	err = checkMode("dir", mode)
+	if err != nil {
+		return
+	}
+	handler.dirMode = mode
+	for _, dir := range handler.createdDirs {
+		err = os.Chmod(dir, mode)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// SetOwner sets the user and group id of the log files, -1 keeps the id of
+// the process. Changing the owner usually needs root
+func (handler *BasicHandler) SetOwner(uid, gid int) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	err = checkOwner(uid, gid)
+	if err != nil {
+		return
+	}
+	handler.uid = uid
+	handler.gid = gid
+	if file := handler.currentFile(); file != nil && (uid != -1 || gid != -1) {
+		err = file.Chown(uid, gid)
+	}
+	return
+}
+
+// lookupOwner returns the id of a user or a group given by name or id, an
+// empty name is -1
+func lookupOwner(name string, group bool) (id int, err error) {
+	if name == "" {
+		return -1, nil
+	}
+	id, err = strconv.Atoi(name)
+	if err == nil {
+		return
+	}
+	if group {
+		g, err1 := user.LookupGroup(name)
+		if err1 != nil {
+			return -1, err1
+		}
+		return strconv.Atoi(g.Gid)
+	}
+	u, err1 := user.Lookup(name)
+	if err1 != nil {
+		return -1, err1
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+func parseMode(mode string) (fileMode os.FileMode, err error) {
+	n, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return
+	}
+	fileMode = os.FileMode(n)
+	return
+}
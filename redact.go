@@ -0,0 +1,253 @@
+package logging
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "regexp"
+import "strings"
+import "sync"
+
+// redactedMask replaces every secret
+const redactedMask = "***"
+
+// Redacted is a value which always renders as "***", wrap secrets in it
+// before giving them to With or to a format
+type Redacted string
+
+func (Redacted) String() string {
+	return redactedMask
+}
+
+func (Redacted) GoString() string {
+	return redactedMask
+}
+
+func (Redacted) Format(f fmt.State, verb rune) {
+	f.Write([]byte(redactedMask))
+}
+
+func (Redacted) MarshalJSON() ([]byte, error) {
+	return json.Marshal(redactedMask)
+}
+
+// redactPattern masks what expr matches, or only its first group when it
+// has one. check, when set, must accept the match
+type redactPattern struct {
+	name  string
+	expr  *regexp.Regexp
+	check func(match string) bool
+}
+
+// Redactor masks secrets in the messages and fields of records before a
+// handler formats them. It is safe to share between handlers
+type Redactor struct {
+	mu       *sync.RWMutex
+	patterns []redactPattern
+	keys     []string
+}
+
+// DefaultRedactKeys are the field names masked by NewRedactor, a field is
+// masked when its lower case name, with "-" as "_", contains one of them
+var DefaultRedactKeys = []string{"password", "passwd", "secret", "token", "authorization", "api_key", "apikey", "cookie", "private_key"}
+
+// NewRedactor returns a Redactor masking bearer tokens, AWS keys, emails,
+// card numbers passing the Luhn check and the fields in DefaultRedactKeys
+func NewRedactor() *Redactor {
+	redactor := &Redactor{mu: new(sync.RWMutex)}
+	redactor.patterns = []redactPattern{
+		{name: "bearer", expr: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]{8,}=*)`)},
+		{name: "awsAccessKey", expr: regexp.MustCompile(`\b((?:AKIA|ASIA|AGPA|AIDA|AROA|ANPA)[0-9A-Z]{16})\b`)},
+		{name: "awsSecretKey", expr: regexp.MustCompile(`(?i)aws_?secret_?(?:access_?)?key["']?\s*[=:]\s*["']?([A-Za-z0-9/+=]{40})\b`)},
+		{name: "email", expr: regexp.MustCompile(`\b[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}\b`)},
+		{name: "card", expr: regexp.MustCompile(`\b\d(?:[ \-]?\d){12,18}\b`), check: luhn},
+	}
+	redactor.keys = append(redactor.keys, DefaultRedactKeys...)
+	return redactor
+}
+
+// AddPattern masks what expr matches, or its first group when it has one.
+// Patterns apply in the order they are added, a pattern added again under
+// the same name is replaced in place
+func (redactor *Redactor) AddPattern(name string, expr string) (err error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return
+	}
+	redactor.mu.Lock()
+	defer redactor.mu.Unlock()
+	for i := range redactor.patterns {
+		if redactor.patterns[i].name == name {
+			redactor.patterns[i] = redactPattern{name: name, expr: re}
+			return
+		}
+	}
+	redactor.patterns = append(redactor.patterns, redactPattern{name: name, expr: re})
+	return
+}
+
+// RemovePattern stops masking the pattern called name, such as "email"
+func (redactor *Redactor) RemovePattern(name string) {
+	redactor.mu.Lock()
+	defer redactor.mu.Unlock()
+	patterns := []redactPattern{}
+	for _, pattern := range redactor.patterns {
+		if pattern.name != name {
+			patterns = append(patterns, pattern)
+		}
+	}
+	redactor.patterns = patterns
+}
+
+// AddKey masks the fields whose name contains key, ignoring case
+func (redactor *Redactor) AddKey(key string) (err error) {
+	key = normalizeKey(key)
+	if key == "" {
+		err = errors.New("key can't be empty")
+		return
+	}
+	redactor.mu.Lock()
+	defer redactor.mu.Unlock()
+	redactor.keys = append(redactor.keys, key)
+	return
+}
+
+func normalizeKey(key string) string {
+	return strings.Replace(strings.ToLower(key), "-", "_", -1)
+}
+
+func (redactor *Redactor) isSecretKey(key string) bool {
+	redactor.mu.RLock()
+	defer redactor.mu.RUnlock()
+	key = normalizeKey(key)
+	for _, secret := range redactor.keys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact returns s with the secrets found by the patterns masked
+func (redactor *Redactor) Redact(s string) string {
+	redactor.mu.RLock()
+	defer redactor.mu.RUnlock()
+	for _, pattern := range redactor.patterns {
+		s = pattern.redact(s)
+	}
+	return s
+}
+
+func (pattern redactPattern) redact(s string) string {
+	matches := pattern.expr.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+	redacted := make([]byte, 0, len(s))
+	last := 0
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if len(match) > 2 && match[2] >= 0 {
+			start, end = match[2], match[3]
+		}
+		if pattern.check != nil && !pattern.check(s[start:end]) {
+			continue
+		}
+		redacted = append(redacted, s[last:start]...)
+		redacted = append(redacted, redactedMask...)
+		last = end
+	}
+	redacted = append(redacted, s[last:]...)
+	return string(redacted)
+}
+
+// redactFields returns fields with the secret keys and the secrets in the
+// values masked, fields is returned as it is when nothing was masked
+func (redactor *Redactor) redactFields(fields []Field) []Field {
+	var redacted []Field
+	for i, field := range fields {
+		value := field.Value
+		changed := false
+		switch field.Value.(type) {
+		case nil, bool, Redacted:
+		default:
+			if redactor.isSecretKey(field.Key) {
+				value, changed = Redacted(""), true
+				break
+			}
+			text := string(appendFieldValue(nil, field.Value))
+			if masked := redactor.Redact(text); masked != text {
+				value, changed = masked, true
+			}
+		}
+		if changed && redacted == nil {
+			redacted = make([]Field, len(fields))
+			copy(redacted, fields[:i])
+		}
+		if redacted != nil {
+			redacted[i] = Field{Key: field.Key, Value: value}
+		}
+	}
+	if redacted == nil {
+		return fields
+	}
+	return redacted
+}
+
+// redactedError stands for an error whose message held a secret
+type redactedError struct {
+	message string
+	err     error
+}
+
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// luhn tells whether the digits of number pass the Luhn checksum of card
+// numbers
+func luhn(number string) bool {
+	sum := 0
+	digits := 0
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		n := int(c - '0')
+		if digits%2 == 1 {
+			n *= 2
+			if n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+		digits++
+	}
+	return digits >= 13 && digits <= 19 && sum%10 == 0
+}
+
+// SetRedactor masks secrets in the message, the fields and the stack trace
+// of each record before it is formatted, nil turns redaction off
+func (handler *BasicHandler) SetRedactor(redactor *Redactor) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.redactor = redactor
+	return
+}
+
+// redactRecord masks the secrets of r, the caller of adjustRecord restores it
+func (handler *BasicHandler) redactRecord(r *Record) {
+	r.Message = handler.redactor.Redact(r.Message)
+	r.Stack = handler.redactor.Redact(r.Stack)
+	r.Fields = handler.redactor.redactFields(r.Fields)
+	if r.Err != nil {
+		message := r.Err.Error()
+		if masked := handler.redactor.Redact(message); masked != message {
+			r.Err = &redactedError{message: masked, err: r.Err}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package logging
+
+import "context"
+import "fmt"
+import "os"
+import "os/signal"
+import "sync/atomic"
+import "time"
+
+var shutdownFlag int32
+
+func isShutdown() bool {
+	return atomic.LoadInt32(&shutdownFlag) == 1
+}
+
+// writeAfterShutdown sends records logged after Shutdown to stderr, the
+// handlers are closed by then
+func writeAfterShutdown(name string, logLevel LogLevel, format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s %s %s\n", name, logLevel, formatMessage(format, v...))
+}
+
+// Shutdown flushes and closes every handler installed on a registered logger,
+// each handler once even if it is shared by several loggers. It returns
+// ctx.Err() when ctx is done first. Records logged afterwards go to stderr
+func Shutdown(ctx context.Context) (err error) {
+	mutex.Lock()
+	atomic.StoreInt32(&shutdownFlag, 1)
+	loggers := []*FileLogger{}
+	for _, logger := range globalLogMap {
+		loggers = append(loggers, logger)
+	}
+	mutex.Unlock()
+	handlers := []LogHandler{}
+	closed := map[int]bool{}
+	for _, logger := range loggers {
+		for _, handler := range logger.getHandlers() {
+			id := (*handler).getId()
+			if !closed[id] {
+				closed[id] = true
+				handlers = append(handlers, *handler)
+			}
+		}
+	}
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		for _, handler := range handlers {
+			err1 := handler.Flush()
+			if err1 != nil && err1 != ErrHandlerClosed && err == nil {
+				err = err1
+			}
+			handler.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// ShutdownOnSignal calls Shutdown with the given timeout when one of sig is
+// received. The signal stays caught, so the process keeps running, and it
+// is sent on the returned channel once the handlers are closed for the
+// caller to exit:
+//
+//	<-logging.ShutdownOnSignal(5*time.Second, syscall.SIGTERM)
+//	os.Exit(1)
+func ShutdownOnSignal(timeout time.Duration, sig ...os.Signal) <-chan os.Signal {
+	c := make(chan os.Signal, 1)
+	done := make(chan os.Signal, 1)
+	signal.Notify(c, sig...)
+	go func() {
+		s := <-c
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		Shutdown(ctx)
+		cancel()
+		done <- s
+	}()
+	return done
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package logging
+
+import "os"
+import "sync/atomic"
+import "syscall"
+import "testing"
+import "time"
+
+func TestShutdownOnSignal(t *testing.T) {
+	c := ShutdownOnSignal(time.Second, syscall.SIGUSR1)
+	defer atomic.StoreInt32(&shutdownFlag, 0)
+	// the signal is caught, the process goes on and gets it back once the
+	// handlers are closed
+	err := syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	if err != nil {
+		t.Errorf("TestShutdownOnSignal syscall.Kill() returned %s", err)
+	}
+	select {
+	case s := <-c:
+		if s != syscall.SIGUSR1 {
+			t.Errorf("TestShutdownOnSignal got %s, want %s", s, syscall.SIGUSR1)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("TestShutdownOnSignal got no signal")
+	}
+	if !isShutdown() {
+		t.Errorf("TestShutdownOnSignal Shutdown() was not called")
+	}
+}
@@ -0,0 +1,217 @@
+package logging
+
+import "context"
+import "errors"
+import "log/slog"
+import "os"
+import "path"
+import "runtime"
+import "sync"
+import "time"
+
+// slogLevel maps a slog level to the level at or below it, slog.LevelInfo
+// is DEBUG and slog.LevelWarn is WARNING
+func slogLevel(level slog.Level) LogLevel {
+	switch {
+	case level >= slog.LevelError:
+		return ERROR
+	case level >= slog.LevelWarn:
+		return WARNING
+	default:
+		return DEBUG
+	}
+}
+
+func (logLevel LogLevel) slogLevel() slog.Level {
+	switch logLevel {
+	case DEBUG:
+		return slog.LevelDebug
+	case WARNING:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
+
+// loggerSlogHandler is the slog.Handler returned by FileLogger.SlogHandler
+type loggerSlogHandler struct {
+	logger *FileLogger
+	group  string  // groups opened by WithGroup, each followed by "."
+	fields []Field // added by WithAttrs
+}
+
+// SlogHandler returns a slog.Handler writing to the handlers of the logger,
+// for code using log/slog:
+//
+//	slog.SetDefault(slog.New(logging.GetLogger("app").SlogHandler()))
+//
+// Attributes become fields, the keys of attributes in a group are prefixed
+// with the group name and a dot, like "request.method". slog levels are
+// rounded down to the levels of the logger, slog.LevelInfo logs as DEBUG
+func (fl *FileLogger) SlogHandler() slog.Handler {
+	return &loggerSlogHandler{logger: fl}
+}
+
+func (h *loggerSlogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.logger.Enabled(slogLevel(level))
+}
+
+func (h *loggerSlogHandler) Handle(ctx context.Context, record slog.Record) error {
+	fl := h.logger
+	logLevel := slogLevel(record.Level)
+	if isShutdown() {
+		writeAfterShutdown(fl.name, logLevel, "%s", record.Message)
+		return nil
+	}
+	levels := fl.effectiveLevel()
+	if logLevel < levels.level {
+		return nil
+	}
+	fields := make([]Field, 0, len(fl.fields)+len(h.fields)+record.NumAttrs())
+	fields = append(fields, fl.fields...)
+	fields = append(fields, h.fields...)
+	record.Attrs(func(attr slog.Attr) bool {
+		fields = appendAttr(fields, h.group, attr)
+		return true
+	})
+	t := record.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	r := recordPool.Get().(*Record)
+	*r = Record{Name: fl.name, Level: logLevel, Time: t, Message: record.Message, Fields: fields}
+	if levels.needCaller && record.PC != 0 {
+		r.setCallerPC(record.PC)
+	}
+	if logLevel >= levels.stackLevel && record.PC != 0 {
+		r.setStackFrom(record.PC)
+	}
+	fl.dispatch(r)
+	*r = Record{}
+	recordPool.Put(r)
+	return nil
+}
+
+func (h *loggerSlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	fields := make([]Field, len(h.fields), len(h.fields)+len(attrs))
+	copy(fields, h.fields)
+	for _, attr := range attrs {
+		fields = appendAttr(fields, h.group, attr)
+	}
+	return &loggerSlogHandler{logger: h.logger, group: h.group, fields: fields}
+}
+
+func (h *loggerSlogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &loggerSlogHandler{logger: h.logger, group: h.group + name + ".", fields: h.fields}
+}
+
+// appendAttr appends attr as fields, a group is flattened with its name as
+// a prefix and empty attributes and groups are left out as slog requires
+func appendAttr(fields []Field, prefix string, attr slog.Attr) []Field {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return fields
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			prefix += attr.Key + "."
+		}
+		for _, a := range attr.Value.Group() {
+			fields = appendAttr(fields, prefix, a)
+		}
+		return fields
+	}
+	return append(fields, Field{Key: prefix + attr.Key, Value: attr.Value.Any()})
+}
+
+// setCallerPC records the caller at the return address pc
+func (r *Record) setCallerPC(pc uintptr) {
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	r.PathName = frame.File
+	r.LineNo = frame.Line
+	r.FuncName = path.Base(frame.Function)
+	r.PC = pc
+}
+
+// setStackFrom records the stack trace starting at the caller with the
+// return address pc, no stack is taken when pc isn't on the current stack
+func (r *Record) setStackFrom(pc uintptr) {
+	var pcs [maxStackDepth]uintptr
+	n := runtime.Callers(2, pcs[:])
+	for i := 0; i < n; i++ {
+		if pcs[i] == pc {
+			buf := getBuffer()
+			*buf = appendFrames(*buf, pcs[i:n])
+			r.Stack = string(*buf)
+			putBuffer(buf)
+			return
+		}
+	}
+}
+
+// SlogHandler sends the records of a logger to a slog.Handler. The level,
+// the time location, the redactor and the stack level of the handler apply
+// as for the other handlers, the format and the file settings are unused.
+// Don't give it a handler from SlogHandler of a logger holding it
+type SlogHandler struct {
+	BasicHandler
+	handler slog.Handler
+}
+
+func GetSlogHandler(handler slog.Handler) (slogHandler *SlogHandler, err error) {
+	if handler == nil {
+		err = errors.New("slog handler can't be nil")
+		return
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	slogHandler = new(SlogHandler)
+	logConfig := GetBasicConfig()
+	slogHandler.handler = handler
+	slogHandler.logConfig = &logConfig
+	slogHandler.mu = new(sync.Mutex)
+	slogHandler.id = handlerId
+	handlerId++
+	slogHandler.fallback = os.Stderr
+	slogHandler.stackLevel = noLevel
+	slogHandler.setPermissions(DefaultPermissions())
+	slogHandler.setFormatter()
+	return
+}
+
+// needsCaller is always true so the slog record gets its source
+func (handler *SlogHandler) needsCaller() bool {
+	return true
+}
+
+func (handler *SlogHandler) writeLog(r *Record) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if handler.closed {
+		return ErrHandlerClosed
+	}
+	ctx := context.Background()
+	level := r.Level.slogLevel()
+	if !handler.handler.Enabled(ctx, level) {
+		return
+	}
+	saved := handler.adjustRecord(r)
+	record := slog.NewRecord(r.Time, level, r.Message, r.PC)
+	record.AddAttrs(slog.String("logger", r.Name))
+	for _, field := range r.Fields {
+		record.AddAttrs(slog.Any(field.Key, field.Value))
+	}
+	if r.Stack != "" {
+		record.AddAttrs(slog.String("stack", r.Stack))
+	}
+	*r = saved
+	err = handler.handler.Handle(ctx, record)
+	handler.reportError(err)
+	return
+}
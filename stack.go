@@ -0,0 +1,102 @@
+package logging
+
+import "errors"
+import "fmt"
+import "runtime"
+import "strconv"
+import "strings"
+
+// maxStackDepth limits the frames kept in a stack trace
+const maxStackDepth = 64
+
+// setStack records the stack trace of the caller skip frames above the
+// function calling it, followed by the stacks carried by the error chain
+func (r *Record) setStack(skip int, err error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = appendStack(*buf, skip+1)
+	if stack := errorStack(err); stack != "" {
+		*buf = append(*buf, '\n')
+		*buf = append(*buf, stack...)
+	}
+	r.Stack = string(*buf)
+}
+
+// appendStack appends the frames above the function calling it in the
+// layout of runtime/debug.Stack, logging helpers are left out
+func appendStack(buf []byte, skip int) []byte {
+	var pcs [maxStackDepth]uintptr
+	n := runtime.Callers(skip+2, pcs[:])
+	return appendFrames(buf, pcs[:n])
+}
+
+// appendFrames appends the frames of the return addresses in pcs
+func appendFrames(buf []byte, pcs []uintptr) []byte {
+	frames := runtime.CallersFrames(pcs)
+	first := true
+	for {
+		frame, more := frames.Next()
+		if first && more && isHelper(frame.Function) {
+			continue
+		}
+		if !first {
+			buf = append(buf, '\n')
+		}
+		first = false
+		buf = append(buf, frame.Function...)
+		buf = append(buf, "()\n\t"...)
+		buf = append(buf, frame.File...)
+		buf = append(buf, ':')
+		buf = strconv.AppendInt(buf, int64(frame.Line), 10)
+		if !more {
+			break
+		}
+	}
+	return buf
+}
+
+type stacker interface {
+	Stack() []byte
+}
+
+// errorStack collects the stacks carried by err and the errors it wraps,
+// from a Stack() []byte method or from the "%+v" verb of errors which
+// implement fmt.Formatter
+func errorStack(err error) string {
+	stacks := []string{}
+	for ; err != nil; err = errors.Unwrap(err) {
+		if s, ok := err.(stacker); ok {
+			stacks = append(stacks, err.Error()+":\n"+strings.TrimRight(string(s.Stack()), "\n"))
+			continue
+		}
+		if _, ok := err.(fmt.Formatter); ok {
+			detail := fmt.Sprintf("%+v", err)
+			if detail != err.Error() {
+				// the verbose form already covers the wrapped errors
+				stacks = append(stacks, strings.TrimRight(detail, "\n"))
+				break
+			}
+		}
+	}
+	return strings.Join(stacks, "\n")
+}
+
+// SetStackLevel makes the handler show the stack trace of records at or
+// above logLevel with %(stack), a level above ERROR turns it off. Records
+// logged with ErrorErr always carry their stack
+func (handler *BasicHandler) SetStackLevel(logLevel LogLevel) (err error) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if logLevel < DEBUG || logLevel > noLevel {
+		logLevel = noLevel
+	}
+	handler.stackLevel = logLevel
+	invalidateLevels()
+	return
+}
+
+func (handler *BasicHandler) getStackLevel() LogLevel {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	return handler.stackLevel
+}
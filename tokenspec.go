@@ -0,0 +1,163 @@
+package logging
+
+import "bytes"
+import "errors"
+import "unicode/utf8"
+
+// maxTokenWidth bounds the width and the precision of a token
+const maxTokenWidth = 1024
+
+// tokenSpec is the printf-like part following a token, as in python's
+// "%(levelName)-8s": "-" aligns left, the width pads with spaces and the
+// precision truncates. The modifiers come inside the parentheses,
+// "%(pathName|tail).30s" keeps the end of a long path and
+// "%(levelName|lower)" changes the case
+type tokenSpec struct {
+	leftAlign bool
+	width     int
+	precision int // -1 when the value is not truncated
+	modifiers []string
+}
+
+// parseTokenSpec reads "[-][width][.precision]s" from the start of s, n is 0
+// when s does not start with a spec. The closing "s" must end the word, so
+// "%(count)5sec" is the token followed by the literal "5sec"
+func parseTokenSpec(s string) (spec tokenSpec, n int) {
+	spec.precision = -1
+	i := 0
+	if i < len(s) && s[i] == '-' {
+		spec.leftAlign = true
+		i++
+	}
+	width, j := parseDigits(s[i:])
+	i += j
+	spec.width = width
+	if i < len(s) && s[i] == '.' {
+		precision, j := parseDigits(s[i+1:])
+		if j == 0 {
+			return tokenSpec{precision: -1}, 0
+		}
+		spec.precision = precision
+		i += 1 + j
+	}
+	if i >= len(s) || s[i] != 's' || i+1 < len(s) && isWordByte(s[i+1]) {
+		return tokenSpec{precision: -1}, 0
+	}
+	return spec, i + 1
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+func parseDigits(s string) (value int, n int) {
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		if value <= maxTokenWidth {
+			value = value*10 + int(s[n]-'0')
+		}
+		n++
+	}
+	return
+}
+
+// wrap returns token itself when the spec changes nothing
+func (spec tokenSpec) wrap(token formatToken) (formatToken, error) {
+	if spec.width > maxTokenWidth || spec.precision > maxTokenWidth {
+		return nil, errors.New("width and precision can't be larger than 1024")
+	}
+	upper, lower, tail := false, false, false
+	for _, modifier := range spec.modifiers {
+		switch modifier {
+		case "upper":
+			upper = true
+		case "lower":
+			lower = true
+		case "tail":
+			tail = true
+		default:
+			return nil, errors.New("unknown modifier " + modifier)
+		}
+	}
+	if upper && lower {
+		return nil, errors.New("upper and lower can't be used together")
+	}
+	if tail && spec.precision < 0 {
+		return nil, errors.New("tail needs a precision like .20s")
+	}
+	if !upper && !lower && spec.width == 0 && spec.precision < 0 {
+		return token, nil
+	}
+	return func(buf []byte, r *Record) []byte {
+		start := len(buf)
+		buf = token(buf, r)
+		if upper || lower {
+			buf = changeCase(buf, start, upper)
+		}
+		count := utf8.RuneCount(buf[start:])
+		if spec.precision >= 0 && count > spec.precision {
+			buf = truncate(buf, start, count-spec.precision, tail)
+			count = spec.precision
+		}
+		if count < spec.width {
+			buf = pad(buf, start, spec.width-count, spec.leftAlign)
+		}
+		return buf
+	}, nil
+}
+
+// changeCase changes the case of buf[start:] in place for ASCII values
+func changeCase(buf []byte, start int, upper bool) []byte {
+	value := buf[start:]
+	for _, c := range value {
+		if c >= utf8.RuneSelf {
+			if upper {
+				return append(buf[:start], bytes.ToUpper(value)...)
+			}
+			return append(buf[:start], bytes.ToLower(value)...)
+		}
+	}
+	for i, c := range value {
+		if upper && c >= 'a' && c <= 'z' {
+			value[i] = c - 'a' + 'A'
+		} else if !upper && c >= 'A' && c <= 'Z' {
+			value[i] = c - 'A' + 'a'
+		}
+	}
+	return buf
+}
+
+// truncate drops drop runes from the end of buf[start:], or from its start
+// when tail is set
+func truncate(buf []byte, start int, drop int, tail bool) []byte {
+	if tail {
+		i := start
+		for ; drop > 0; drop-- {
+			_, size := utf8.DecodeRune(buf[i:])
+			i += size
+		}
+		n := copy(buf[start:], buf[i:])
+		return buf[:start+n]
+	}
+	i := len(buf)
+	for ; drop > 0; drop-- {
+		_, size := utf8.DecodeLastRune(buf[start:i])
+		i -= size
+	}
+	return buf[:i]
+}
+
+// pad adds n spaces after buf[start:], or before it when the value is right
+// aligned
+func pad(buf []byte, start int, n int, leftAlign bool) []byte {
+	end := len(buf)
+	for i := 0; i < n; i++ {
+		buf = append(buf, ' ')
+	}
+	if !leftAlign {
+		copy(buf[start+n:], buf[start:end])
+		for i := start; i < start+n; i++ {
+			buf[i] = ' '
+		}
+	}
+	return buf
+}
@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package logging
+
+import "syscall"
+import "unsafe"
+
+// isTerminal asks the terminal driver for the settings of fd, only a tty
+// has them
+func isTerminal(fd uintptr) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package logging
+
+// isTerminal can't tell a tty on this platform, colors have to be enabled
+// with SetColor or FORCE_COLOR
+func isTerminal(fd uintptr) bool {
+	return false
+}